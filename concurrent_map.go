@@ -1,57 +1,1001 @@
 package cmap
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
+// Number of shards used by NewDefault.
+// It has no effect on maps created with an explicit shard count, e.g. New(64),
+// nor on maps which were already created.
+var SHARDS_COUNT = 32
+
+// A ConcurrentHashMap must not be copied after first use, always pass it by pointer.
+// The zero value is an empty map ready to use, it gets SHARDS_COUNT shards.
 type ConcurrentHashMap struct {
+	noCopy noCopy
+
+	// Shard layout, replaced by Resize.
+	// Must not be read while a Resize may be running, use ShardCounts instead.
 	Shards  int
 	HashMap ConcurrentMap
+
+	table     atomic.Pointer[shardTable]  // Current shard layout, used by every operation.
+	resizeMu  sync.RWMutex                // Taken for writing by Resize, for reading by writes spanning shards.
+	size      atomic.Int64                // Number of elements, updated whenever a key is added or removed.
+	sizeSum   atomic.Int64                // Sum of the sizes given to SetWithSize for the current elements.
+	observer  atomic.Pointer[Observer]    // Set by SetObserver, nil when disabled.
+	marshal   atomic.Pointer[MarshalFunc] // Set by SetMarshalFunc, nil when values are marshaled as is.
+	watches   watchRegistry               // Subscribers registered by Watch.
+	versioned atomic.Bool                 // Set by SetVersioned, every write records a version from then on.
+	maxSize   int64                       // Number of elements TrySet admits when capped.
+	capped    bool                        // Set by NewCapped, TrySet ignores maxSize otherwise.
+	initOnce  sync.Once                   // Adopts the exported fields of a map not created by New.
 }
 
+// Marks the struct embedding it as not to be copied. ConcurrentHashMap
+// already holds a mutex and atomics which go vet's copylocks check reports,
+// so noCopy documents the intent rather than adding vet coverage.
+// See https://golang.org/issues/8005#issuecomment-190753527.
+type noCopy struct{}
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
+
 // A "thread" safe map of type string:Anything.
 // To avoid lock bottlenecks this map is dived to several (Shards) map shards.
 type ConcurrentMap []*ConcurrentMapShared
 
 // A "thread" safe string to anything map.
 type ConcurrentMapShared struct {
-	items        map[string]interface{}
-	sync.RWMutex // Read Write mutex, guards access to internal map.
+	items         map[string]interface{}
+	retired       bool                     // Set by Resize once items were moved to new shards.
+	writeHeavy    bool                     // Readers take mu too, see Options.WriteHeavy.
+	readOptimized bool                     // Get reads published, see Options.ReadOptimized.
+	published     atomic.Value             // Entries of items as a map[string]*readEntry, read by Get with readOptimized.
+	unpublished   atomic.Bool              // Keys were added to items since it was last published.
+	misses        atomic.Int64             // Lookups of Get which needed the lock since items was last published.
+	stale         bool                     // items was replaced or modified by WithShardLock since it was last published.
+	autoShrink    bool                     // Rebuild items once it shrank enough, see Options.AutoShrink.
+	peak          int                      // Most elements held since items was rebuilt, kept with autoShrink.
+	hits          map[string]*atomic.Int64 // Get counters per key, nil unless Options.TrackAccess.
+	versions      map[string]uint64        // Versions per key, nil until the shard is written once the map is versioned.
+	sizes         map[string]int           // Sizes per key, nil until SetWithSize uses the shard.
+	contention    *shardContention         // Lock statistics, nil unless Options.TrackContention.
+	pending       []pendingEvent           // Watch events queued under the lock, delivered by unlock.
+	observed      []pendingOp              // Observer calls queued under the lock, made by unlock.
+	mu            sync.Mutex               // Guards access to internal map of write heavy shards.
+	sync.RWMutex                           // Read Write mutex, guards access to internal map.
 }
 
-// Creates a new concurrent map.
-func New(shards int) *ConcurrentHashMap {
-	m := &ConcurrentHashMap{Shards: shards, HashMap: make(ConcurrentMap, shards)}
+// Removes every element of the write locked shard, along with their counters,
+// versions and sizes.
+func (s *ConcurrentMapShared) reset() {
+	s.items = make(map[string]interface{})
+	s.stale = true
+	if s.hits != nil {
+		s.hits = make(map[string]*atomic.Int64)
+	}
+	if s.versions != nil {
+		s.versions = make(map[string]uint64)
+	}
+	s.sizes = nil
+	s.peak = 0
+}
+
+// Copies the elements of the write locked shard, along with their counters
+// and versions, into maps sized to fit them, releasing the memory Go maps
+// keep after many deletions.
+func (s *ConcurrentMapShared) trim() {
+	items := make(map[string]interface{}, len(s.items))
+	for key, value := range s.items {
+		items[key] = value
+	}
+	s.items = items
+	if s.hits != nil {
+		hits := make(map[string]*atomic.Int64, len(s.hits))
+		for key, counter := range s.hits {
+			hits[key] = counter
+		}
+		s.hits = hits
+	}
+	if s.versions != nil {
+		versions := make(map[string]uint64, len(s.versions))
+		for key, version := range s.versions {
+			versions[key] = version
+		}
+		s.versions = versions
+	}
+	if s.sizes != nil {
+		sizes := make(map[string]int, len(s.sizes))
+		for key, size := range s.sizes {
+			sizes[key] = size
+		}
+		s.sizes = sizes
+	}
+	s.peak = len(items)
+}
+
+// Records the number of elements of the write locked shard after an insertion.
+func (s *ConcurrentMapShared) trackPeak() {
+	if s.autoShrink && len(s.items) > s.peak {
+		s.peak = len(s.items)
+	}
+}
+
+// Restarts tracking the peak of the shard from its current elements,
+// once items was replaced as a whole.
+func (s *ConcurrentMapShared) resetPeak() {
+	if s.autoShrink {
+		s.peak = len(s.items)
+	}
+}
+
+// Number of lock acquisitions of a shard, and how many of them had to wait.
+type shardContention struct {
+	acquired, contended atomic.Int64
+}
+
+// Shard locking used by the map methods, write heavy shards take mu
+// for both reads and writes.
+func (s *ConcurrentMapShared) lock() {
+	if s.contention != nil {
+		s.contention.acquired.Add(1)
+		if s.tryLock() {
+			return
+		}
+		s.contention.contended.Add(1)
+	}
+	if s.writeHeavy {
+		s.mu.Lock()
+		return
+	}
+	s.RWMutex.Lock()
+}
+
+// Element of a read optimized shard, shared by the published maps
+// as long as its key stays in the shard.
+type readEntry struct {
+	p atomic.Pointer[interface{}] // Current value, nil once the key was removed.
+}
+
+// Returns the entries published for the lock free readers of the shard.
+func (s *ConcurrentMapShared) view() map[string]*readEntry {
+	entries, _ := s.published.Load().(map[string]*readEntry)
+	return entries
+}
+
+// Makes value, just stored under key in the write locked shard, visible to
+// lock free readers if the shard is read optimized. Updates of published
+// keys are stored into their entry. New keys are only published once Get
+// missed them often enough, until then Get looks them up under the lock,
+// so loading a shard key by key doesn't copy it for every key.
+func (s *ConcurrentMapShared) publishSet(key string, value interface{}) {
+	if !s.readOptimized || s.stale {
+		return
+	}
+	if e := s.view()[key]; e != nil {
+		e.p.Store(&value)
+		return
+	}
+	s.unpublished.Store(true)
+}
+
+// Hides key, just removed from the write locked shard, from lock free readers
+// if the shard is read optimized.
+func (s *ConcurrentMapShared) publishRemove(key string) {
+	if !s.readOptimized || s.stale {
+		return
+	}
+	if e := s.view()[key]; e != nil {
+		e.p.Store(nil)
+	}
+}
+
+// Publishes the entries of items for the lock free readers of a read
+// optimized shard. Entries of the last published map are reused, unless
+// the shard is stale, in which case their values may be outdated.
+func (s *ConcurrentMapShared) publish() {
+	stale := s.stale
+	s.stale = false
+	if !s.readOptimized {
+		return
+	}
+	old := s.view()
+	entries := make(map[string]*readEntry, len(s.items))
+	for key, value := range s.items {
+		e := old[key]
+		if e == nil || stale {
+			e = &readEntry{}
+			v := value
+			e.p.Store(&v)
+		}
+		entries[key] = e
+	}
+	s.published.Store(entries)
+	// Cleared once the entries are visible, see Get.
+	s.unpublished.Store(false)
+	s.misses.Store(0)
+}
+
+// Like lock, but gives up once timeout elapsed. Returns whether the lock is held.
+func (s *ConcurrentMapShared) lockTimeout(timeout time.Duration) bool {
+	return s.acquireWithin(timeout, s.tryLock)
+}
+
+// Like rlock, but gives up once timeout elapsed. Returns whether the lock is held.
+func (s *ConcurrentMapShared) rlockTimeout(timeout time.Duration) bool {
+	return s.acquireWithin(timeout, s.tryRLock)
+}
+
+// Retries try, backing off up to a millisecond between attempts, until it
+// succeeds or timeout elapsed.
+func (s *ConcurrentMapShared) acquireWithin(timeout time.Duration, try func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for attempt, backoff := 0, time.Microsecond; ; attempt++ {
+		if try() {
+			if s.contention != nil {
+				s.contention.acquired.Add(1)
+				if attempt > 0 {
+					s.contention.contended.Add(1)
+				}
+			}
+			return true
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false
+		}
+		if backoff > left {
+			backoff = left
+		}
+		time.Sleep(backoff)
+		if backoff < time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *ConcurrentMapShared) tryLock() bool {
+	if s.writeHeavy {
+		return s.mu.TryLock()
+	}
+	return s.RWMutex.TryLock()
+}
+
+func (s *ConcurrentMapShared) unlock() {
+	if s.stale {
+		s.publish()
+	}
+	pending, observed := s.pending, s.observed
+	s.pending, s.observed = nil, nil
+	if s.writeHeavy {
+		s.mu.Unlock()
+	} else {
+		s.RWMutex.Unlock()
+	}
+	// Watchers and observers are notified once the shard is unlocked.
+	for _, p := range pending {
+		for _, w := range p.watchers {
+			w.send(p.event)
+		}
+	}
+	for _, op := range observed {
+		if op.removed {
+			op.observer.OnRemove(op.key)
+		} else {
+			op.observer.OnSet(op.key)
+		}
+	}
+}
+
+func (s *ConcurrentMapShared) rlock() {
+	if s.contention != nil {
+		s.contention.acquired.Add(1)
+		if s.tryRLock() {
+			return
+		}
+		s.contention.contended.Add(1)
+	}
+	if s.writeHeavy {
+		s.mu.Lock()
+		return
+	}
+	s.RWMutex.RLock()
+}
+
+func (s *ConcurrentMapShared) tryRLock() bool {
+	if s.writeHeavy {
+		return s.mu.TryLock()
+	}
+	return s.RWMutex.TryRLock()
+}
+
+func (s *ConcurrentMapShared) runlock() {
+	if s.writeHeavy {
+		s.mu.Unlock()
+		return
+	}
+	s.RWMutex.RUnlock()
+}
+
+// Shard layout of a ConcurrentHashMap, swapped as a whole by Resize.
+type shardTable struct {
+	shards   ConcurrentMap
+	hasher   func(key string) uint32
+	hasherID uintptr // Identity of hasher, see hasherIdentity.
+	opts     Options
+}
+
+// Returns the identity of the func value hasher, 0 for nil. Uses of one
+// top level function, e.g. XXHash32, share their identity, as do maps cloned
+// or resized from each other, while every closure gets its own: closures of
+// one function literal may capture different state, e.g. a seed.
+func hasherIdentity(hasher func(key string) uint32) uintptr {
+	if hasher == nil {
+		return 0
+	}
+	// A func value points to the code and captured variables of the function.
+	return *(*uintptr)(unsafe.Pointer(&hasher))
+}
+
+// Largest number of elements a shard's map is sized for up front.
+const maxShardCapacity = 1 << 20
+
+// Smallest peak of a shard Options.AutoShrink rebuilds, smaller maps aren't worth it.
+const minShrinkPeak = 64
+
+func makeShards(shards int, opts Options) ConcurrentMap {
+	hint := opts.Capacity / shards
+	if hint < 0 {
+		hint = 0
+	} else if hint > maxShardCapacity {
+		hint = maxShardCapacity
+	}
+	hashMap := make(ConcurrentMap, shards)
 	for i := 0; i < shards; i++ {
-		m.HashMap[i] = &ConcurrentMapShared{items: make(map[string]interface{})}
+		hashMap[i] = &ConcurrentMapShared{items: make(map[string]interface{}, hint), writeHeavy: opts.WriteHeavy}
+		if opts.AutoShrink {
+			hashMap[i].autoShrink, hashMap[i].peak = true, hint
+		}
+		if opts.ReadOptimized {
+			hashMap[i].readOptimized = true
+			hashMap[i].publish()
+		}
+		if opts.TrackAccess {
+			hashMap[i].hits = make(map[string]*atomic.Int64)
+		}
+		if opts.TrackContention {
+			hashMap[i].contention = &shardContention{}
+		}
+	}
+	return hashMap
+}
+
+// Returned by NewChecked for a shard count below one,
+// the other constructors and Resize panic with it.
+var ErrInvalidShards = errors.New("cmap: shard count must be at least 1")
+
+func newMap(shards int, hasher func(key string) uint32, opts Options) *ConcurrentHashMap {
+	if shards <= 0 {
+		panic(ErrInvalidShards)
+	}
+	m := &ConcurrentHashMap{Shards: shards, HashMap: makeShards(shards, opts)}
+	m.table.Store(&shardTable{shards: m.HashMap, hasher: hasher, hasherID: hasherIdentity(hasher), opts: opts})
+	return m
+}
+
+// Creates a new concurrent map, panics if shards < 1.
+func New(shards int) *ConcurrentHashMap {
+	return newMap(shards, nil, Options{})
+}
+
+// Creates a new concurrent map sized to hold expectedTotal elements without
+// growing, e.g. before a bulk load. The size is a hint, each shard is sized
+// for at most 1<<20 elements.
+func NewWithCapacity(shards, expectedTotal int) *ConcurrentHashMap {
+	return newMap(shards, nil, Options{Capacity: expectedTotal})
+}
+
+// Creates a new concurrent map like New,
+// but returns ErrInvalidShards instead of panicking if shards < 1.
+func NewChecked(shards int) (*ConcurrentHashMap, error) {
+	if shards <= 0 {
+		return nil, ErrInvalidShards
+	}
+	return New(shards), nil
+}
+
+// Options of NewWithOptions.
+type Options struct {
+	// Number of shards, SHARDS_COUNT is used if it is 0.
+	Shards int
+	// Guard every shard with a sync.Mutex rather than a sync.RWMutex,
+	// readers then lock shards exclusively. This is cheaper when writes
+	// dominate, the RWMutex remains the better choice for read heavy loads.
+	// Callbacks called under a read lock, e.g. by IterCb, deadlock right
+	// away if they read the map, even a Get of the key they were given.
+	WriteHeavy bool
+	// Count Get calls per key, see HotKeys. Meant for investigations,
+	// as it costs memory and an atomic increment per Get.
+	TrackAccess bool
+	// Count how often locking a shard had to wait, see ContentionStats.
+	// Maps without it don't pay for the bookkeeping.
+	TrackContention bool
+	// Expected number of elements, shards are sized up front to hold
+	// their part of it, which avoids rehashing while the map is loaded.
+	Capacity int
+	// Let Get read shards without locking. Every reader of a sync.RWMutex
+	// updates the lock's shared state, which readers on many cores contend
+	// on even when nobody writes, lock free readers don't. On a few cores
+	// both are about as fast, compare them with BenchmarkReadMostly and
+	// -cpu set to the cores of the target machine. Every shard publishes
+	// its elements in an immutable map of entries, updates of existing keys
+	// are stored into their entry and removals clear it. New keys are read
+	// under the lock until Get missed them about as often as the shard has
+	// elements, the shard's entries are then copied into a new map.
+	// Writes cost an allocation more, WithShardLock, SwapContents and
+	// RestoreShards publish their shards anew. NewWithOptions panics with ErrConflictingOptions
+	// when combined with TrackAccess, which needs the lock in Get.
+	ReadOptimized bool
+	// Rebuild a shard, like TrimShards does, once removals leave it with
+	// less than a quarter of the most elements it held since it was last
+	// rebuilt, provided it held at least 64 of them. This keeps maps with
+	// churning keys from retaining their peak memory forever, at the cost of
+	// an occasional Remove copying the rest of its shard.
+	AutoShrink bool
+}
+
+// Returned, wrapped in a panic, by NewWithOptions for options which can't be combined.
+var ErrConflictingOptions = errors.New("cmap: conflicting options")
+
+// Creates a new concurrent map configured by opts.
+// Panics with an error wrapping ErrConflictingOptions if opts enable both
+// ReadOptimized and TrackAccess.
+func NewWithOptions(opts Options) *ConcurrentHashMap {
+	if opts.ReadOptimized && opts.TrackAccess {
+		panic(fmt.Errorf("%w: ReadOptimized and TrackAccess", ErrConflictingOptions))
 	}
+	shards := opts.Shards
+	if shards == 0 {
+		shards = SHARDS_COUNT
+	}
+	return newMap(shards, nil, opts)
+}
+
+// Creates a new concurrent map with SHARDS_COUNT shards.
+func NewDefault() *ConcurrentHashMap {
+	return New(SHARDS_COUNT)
+}
+
+// Creates a new concurrent map holding at most maxTotal elements,
+// use TrySet to insert elements into it. A maxTotal of 0 makes TrySet
+// reject every new key, NewCapped panics if maxTotal is negative.
+func NewCapped(shards, maxTotal int) *ConcurrentHashMap {
+	if maxTotal < 0 {
+		panic("cmap: NewCapped needs a non negative maxTotal")
+	}
+	m := New(shards)
+	m.maxSize = int64(maxTotal)
+	m.capped = true
 	return m
 }
 
-// Returns shard under given key
+// Creates a new concurrent map which uses hasher to pick the shard of a key,
+// e.g. XXHash32. The default fnv32 is used when hasher is nil.
+func NewWithHasher(shards int, hasher func(key string) uint32) *ConcurrentHashMap {
+	return newMap(shards, hasher, Options{})
+}
+
+// Returns the current shard layout, a map which wasn't created
+// by New adopts its exported fields on first use. A map without shards
+// is initialized with Shards shards, or SHARDS_COUNT if Shards is 0, e.g.
+// for a zero ConcurrentHashMap. A negative Shards panics with ErrInvalidShards.
+func (m *ConcurrentHashMap) loadTable() *shardTable {
+	if t := m.table.Load(); t != nil {
+		return t
+	}
+	m.initOnce.Do(func() {
+		if len(m.HashMap) == 0 {
+			if m.Shards < 0 {
+				panic(ErrInvalidShards)
+			}
+			if m.Shards == 0 {
+				m.Shards = SHARDS_COUNT
+			}
+			m.HashMap = makeShards(m.Shards, Options{})
+		}
+		count := 0
+		for _, shard := range m.HashMap {
+			count += len(shard.items)
+		}
+		m.size.Store(int64(count))
+		m.table.Store(&shardTable{shards: m.HashMap})
+	})
+	return m.table.Load()
+}
+
+// Returns shard under given key.
+// Shards are replaced by Resize, lock the shard only through the map methods.
 func (m *ConcurrentHashMap) GetShard(key string) *ConcurrentMapShared {
-	return m.HashMap[uint(fnv32(key))%uint(m.Shards)]
+	t := m.loadTable()
+	return t.shards[t.index(key)]
+}
+
+// Returns index of the shard under given key, e.g. to group keys by shard
+// before batching operations. The index changes when the map is resized.
+func (m *ConcurrentHashMap) ShardIndex(key string) int {
+	return m.loadTable().index(key)
+}
+
+// Returns the shard at index i, or nil if i is out of range, e.g. for
+// maintenance tools processing shards in parallel with ForEach. Like GetShard,
+// the result refers to the current shards, which Resize replaces.
+func (m *ConcurrentHashMap) ShardByIndex(i int) *ConcurrentMapShared {
+	shards := m.loadTable().shards
+	if i < 0 || i >= len(shards) {
+		return nil
+	}
+	return shards[i]
+}
+
+// Calls fn for every element of the shard while it is read locked.
+// fn MUST NOT access the map, not even to read it, as it can lead to
+// deadlock since Go sync.RWLock is not reentrant.
+func (s *ConcurrentMapShared) ForEach(fn IterCb) {
+	s.rlock()
+	defer s.runlock()
+	for key, value := range s.items {
+		fn(key, value)
+	}
+}
+
+// Returns the shard under given key with its write lock held,
+// retrying on the new shards if Resize retired it meanwhile.
+func (m *ConcurrentHashMap) lockShard(key string) *ConcurrentMapShared {
+	for {
+		shard := m.GetShard(key)
+		shard.lock()
+		if !shard.retired {
+			return shard
+		}
+		shard.unlock()
+	}
+}
+
+// Returns index of the shard under given key
+func (t *shardTable) index(key string) int {
+	// A single shard holds every key, no need to hash it.
+	if len(t.shards) == 1 {
+		return 0
+	}
+	if t.hasher != nil {
+		return shardOf(t.hasher(key), len(t.shards))
+	}
+	return shardOf(fnv32(key), len(t.shards))
+}
+
+// Groups keys by the index of the shard they belong to,
+// so batch operations lock every shard at most once.
+// Shards without any key get a nil group.
+func (t *shardTable) groupByShard(keys []string) [][]string {
+	// Counting sort, every group is a window of one backing slice.
+	indexes := make([]int, len(keys))
+	offsets := make([]int, len(t.shards)+1)
+	for i, key := range keys {
+		indexes[i] = t.index(key)
+		offsets[indexes[i]+1]++
+	}
+	for i := 1; i < len(offsets); i++ {
+		offsets[i] += offsets[i-1]
+	}
+	sorted := make([]string, len(keys))
+	groups := make([][]string, len(t.shards))
+	for i := range groups {
+		groups[i] = sorted[offsets[i]:offsets[i]:offsets[i+1]]
+	}
+	for i, key := range keys {
+		groups[indexes[i]] = append(groups[indexes[i]], key)
+	}
+	return groups
+}
+
+// Receives notifications about map operations, e.g. to feed metrics.
+// Methods are called after the shard lock was released, from the goroutine
+// which performed the operation, so they must be safe for concurrent use.
+// Like Watch, changes made by WithShardLock, SwapContents and RestoreShards
+// aren't reported.
+type Observer interface {
+	// Called for every key written, by any method, e.g. Set, Upsert or Merge.
+	OnSet(key string)
+	// Called by Get, hit reports whether key was found.
+	OnGet(key string, hit bool)
+	// Called for every element removed, by any method, e.g. Remove, RemoveIf
+	// or Clear. Removing a missing key isn't reported.
+	OnRemove(key string)
+}
+
+// Installs o to be notified of map operations, a nil o removes the current
+// observer, in which case operations carry no observer overhead.
+func (m *ConcurrentHashMap) SetObserver(o Observer) {
+	if o == nil {
+		m.observer.Store(nil)
+		return
+	}
+	m.observer.Store(&o)
+}
+
+// Kind of change reported by Watch.
+type EventType int
+
+const (
+	EventSet     EventType = iota // The key was set, Value is the new value.
+	EventRemoved                  // The key was removed, Value is the removed value.
+)
+
+// Change of a watched key, see Watch.
+type Event struct {
+	Type  EventType
+	Value interface{}
+}
+
+// Number of events a Watch channel buffers before dropping new ones.
+const watchBuffer = 16
+
+type watcher struct {
+	mu     sync.Mutex // Guards ch against being closed while sending.
+	ch     chan Event
+	closed bool
+}
+
+// Sends e unless the channel is full or closed, never blocks.
+func (w *watcher) send(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.ch <- e:
+	default:
+	}
+}
+
+// Event waiting in a shard to be delivered to watchers.
+type pendingEvent struct {
+	watchers []*watcher
+	event    Event
+}
+
+// Watchers per key. Slices are replaced, never modified, so lookups may use
+// them without holding mu.
+type watchRegistry struct {
+	count atomic.Int32 // Number of watchers, lets writes skip the lookup.
+	mu    sync.RWMutex
+	keys  map[string][]*watcher
+}
+
+// Returns a channel receiving an Event whenever the element under key is set
+// or removed, and a cancel func which unsubscribes and closes the channel.
+// Events are delivered after the shard is unlocked and never block writers:
+// the channel buffers a few events, further events are dropped until the
+// receiver catches up. Events of concurrent writers may arrive out of order.
+// WithShardLock, SwapContents and RestoreShards don't send events, neither
+// does Resize, which doesn't change any element.
+func (m *ConcurrentHashMap) Watch(key string) (<-chan Event, func()) {
+	w := &watcher{ch: make(chan Event, watchBuffer)}
+	r := &m.watches
+	r.mu.Lock()
+	if r.keys == nil {
+		r.keys = make(map[string][]*watcher)
+	}
+	// Copy rather than append in place, lookups may be using the old slice.
+	watchers := make([]*watcher, len(r.keys[key]), len(r.keys[key])+1)
+	copy(watchers, r.keys[key])
+	r.keys[key] = append(watchers, w)
+	r.count.Add(1)
+	r.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			r.mu.Lock()
+			watchers := make([]*watcher, 0, len(r.keys[key]))
+			for _, other := range r.keys[key] {
+				if other != w {
+					watchers = append(watchers, other)
+				}
+			}
+			if len(watchers) == 0 {
+				delete(r.keys, key)
+			} else {
+				r.keys[key] = watchers
+			}
+			r.count.Add(-1)
+			r.mu.Unlock()
+
+			w.mu.Lock()
+			w.closed = true
+			close(w.ch)
+			w.mu.Unlock()
+		})
+	}
+	return w.ch, cancel
+}
+
+// Observer call waiting in a shard to be made.
+type pendingOp struct {
+	observer Observer
+	key      string
+	removed  bool
+}
+
+// Queues an observer call for key, to be made once the write locked shard is unlocked.
+func (m *ConcurrentHashMap) observe(shard *ConcurrentMapShared, key string, removed bool) {
+	if o := m.observer.Load(); o != nil {
+		shard.observed = append(shard.observed, pendingOp{*o, key, removed})
+	}
+}
+
+// Queues e for the watchers of key, to be sent once the write locked shard is unlocked.
+func (m *ConcurrentHashMap) notify(shard *ConcurrentMapShared, key string, e Event) {
+	if m.watches.count.Load() == 0 {
+		return
+	}
+	m.watches.mu.RLock()
+	watchers := m.watches.keys[key]
+	m.watches.mu.RUnlock()
+	if len(watchers) > 0 {
+		shard.pending = append(shard.pending, pendingEvent{watchers, e})
+	}
+}
+
+// Queues a removal event for every watched element of the write locked shard
+// before it is emptied.
+func (m *ConcurrentHashMap) notifyReset(shard *ConcurrentMapShared) {
+	if m.watches.count.Load() == 0 {
+		return
+	}
+	m.watches.mu.RLock()
+	defer m.watches.mu.RUnlock()
+	for key, watchers := range m.watches.keys {
+		if v, ok := shard.items[key]; ok {
+			shard.pending = append(shard.pending, pendingEvent{watchers, Event{EventRemoved, v}})
+		}
+	}
+}
+
+// Observer counting map operations, install it with SetObserver to have
+// Stats report operation counters.
+type OpCounters struct {
+	sets, hits, misses, removes atomic.Int64
+}
+
+func (o *OpCounters) OnSet(key string) { o.sets.Add(1) }
+func (o *OpCounters) OnGet(key string, hit bool) {
+	if hit {
+		o.hits.Add(1)
+	} else {
+		o.misses.Add(1)
+	}
+}
+func (o *OpCounters) OnRemove(key string) { o.removes.Add(1) }
+
+// Cumulative operation counters, as counted by OpCounters.
+type OpCounts struct {
+	Sets    int64
+	Hits    int64
+	Misses  int64
+	Removes int64
+}
+
+// Returns the operations counted so far.
+func (o *OpCounters) Counts() OpCounts {
+	return OpCounts{o.sets.Load(), o.hits.Load(), o.misses.Load(), o.removes.Load()}
 }
 
 // Sets the given map
 func (m *ConcurrentHashMap) MSet(data map[string]interface{}) {
 	for key, value := range data {
-		shard := m.GetShard(key)
-		shard.Lock()
-		shard.items[key] = value
-		shard.Unlock()
+		shard := m.lockShard(key)
+		m.store(shard, key, value)
+		shard.unlock()
+	}
+}
+
+// Sets the given tuples, e.g. as returned by IterBuffered, without building
+// a map first. Every shard involved is locked only once. If a key appears
+// more than once the last of its tuples wins.
+func (m *ConcurrentHashMap) MSetTuples(items []Tuple) {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	t := m.loadTable()
+	// Positions of the tuples, grouped by shard.
+	groups := make([][]int, len(t.shards))
+	for i, item := range items {
+		idx := t.index(item.Key)
+		groups[idx] = append(groups[idx], i)
+	}
+	for idx, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.lock()
+		for _, i := range group {
+			m.store(shard, items[i].Key, items[i].Val)
+		}
+		shard.unlock()
 	}
 }
 
+// Decides which keys MSetWithPolicy writes.
+type SetPolicy int
+
+const (
+	// Every key is written.
+	Overwrite SetPolicy = iota
+	// Only keys missing from the map are written.
+	InsertOnly
+	// Only keys already in the map are written.
+	UpdateOnly
+)
+
+// Sets the given map according to policy, every shard involved is locked
+// only once. Returns the number of keys actually written.
+func (m *ConcurrentHashMap) MSetWithPolicy(data map[string]interface{}, policy SetPolicy) int {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	written := 0
+	t := m.loadTable()
+	for idx, group := range t.groupByShard(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.lock()
+		for _, key := range group {
+			_, ok := shard.items[key]
+			if (policy == InsertOnly && ok) || (policy == UpdateOnly && !ok) {
+				continue
+			}
+			m.store(shard, key, data[key])
+			written++
+		}
+		shard.unlock()
+	}
+	return written
+}
+
 // Sets the given value under the specified key.
 func (m *ConcurrentHashMap) Set(key string, value interface{}) {
 	// Get map shard.
+	shard := m.lockShard(key)
+	m.store(shard, key, value)
+	shard.unlock()
+}
+
+// Sets the given value under the specified key unless that adds an element
+// to a map created by NewCapped which already holds its maximum number of elements.
+// Updates of existing keys always succeed. Returns whether the value was stored.
+// Only TrySet enforces the cap, elements inserted by other methods count
+// towards it, but are never rejected.
+func (m *ConcurrentHashMap) TrySet(key string, value interface{}) bool {
+	// Get map shard.
+	shard := m.lockShard(key)
+	stored := m.storeCapped(shard, key, value)
+	shard.unlock()
+	return stored
+}
+
+// Stores value under key in the write locked shard unless that adds an
+// element to a full capped map, see TrySet.
+func (m *ConcurrentHashMap) storeCapped(shard *ConcurrentMapShared, key string, value interface{}) bool {
+	if _, ok := shard.items[key]; ok || !m.capped {
+		m.store(shard, key, value)
+		return true
+	}
+	// Reserve room for the new element before inserting it.
+	for {
+		size := m.size.Load()
+		if size >= m.maxSize {
+			return false
+		}
+		if m.size.CompareAndSwap(size, size+1) {
+			break
+		}
+	}
+	shard.items[key] = value
+	shard.publishSet(key, value)
+	shard.trackPeak()
+	m.bumpVersion(shard, key)
+	m.notify(shard, key, Event{EventSet, value})
+	m.observe(shard, key, false)
+	return true
+}
+
+// Sets the given value under the specified key like Set, unless the shard's
+// lock can't be acquired within timeout, e.g. to fail fast under contention
+// in latency sensitive paths. Returns whether the value was stored.
+func (m *ConcurrentHashMap) TrySetTimeout(key string, value interface{}, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		shard := m.GetShard(key)
+		if !shard.lockTimeout(time.Until(deadline)) {
+			return false
+		}
+		if shard.retired {
+			// Resize moved the elements, retry on the new shard.
+			shard.unlock()
+			continue
+		}
+		m.store(shard, key, value)
+		shard.unlock()
+		return true
+	}
+}
+
+// Retrieves an element from map under given key like Get, unless the shard's
+// read lock can't be acquired within timeout. locked reports whether the lock
+// was acquired, if it is false the lookup didn't happen and ok is false too.
+func (m *ConcurrentHashMap) TryGetTimeout(key string, timeout time.Duration) (v interface{}, ok bool, locked bool) {
+	// Get shard
 	shard := m.GetShard(key)
-	shard.Lock()
+	if !shard.rlockTimeout(timeout) {
+		return nil, false, false
+	}
+	v, ok = m.readAndUnlock(shard, key)
+	return v, ok, true
+}
+
+// Stores value under key in the write locked shard, counting new keys.
+func (m *ConcurrentHashMap) store(shard *ConcurrentMapShared, key string, value interface{}) {
+	if _, ok := shard.items[key]; !ok {
+		m.size.Add(1)
+	}
 	shard.items[key] = value
-	shard.Unlock()
+	shard.publishSet(key, value)
+	shard.trackPeak()
+	m.dropSize(shard, key)
+	m.bumpVersion(shard, key)
+	m.notify(shard, key, Event{EventSet, value})
+	m.observe(shard, key, false)
+}
+
+// Deletes key from the write locked shard, returning its value if it existed.
+func (m *ConcurrentHashMap) remove(shard *ConcurrentMapShared, key string) (interface{}, bool) {
+	v, ok := shard.items[key]
+	if ok {
+		delete(shard.items, key)
+		shard.publishRemove(key)
+		delete(shard.hits, key)
+		delete(shard.versions, key)
+		m.dropSize(shard, key)
+		m.size.Add(-1)
+		m.notify(shard, key, Event{EventRemoved, v})
+		m.observe(shard, key, true)
+		if shard.autoShrink && shard.peak >= minShrinkPeak && len(shard.items) < shard.peak/4 {
+			shard.trim()
+		}
+	}
+	return v, ok
 }
 
 // Callback to return new element to be inserted into the map
@@ -62,79 +1006,513 @@ type UpsertCb func(exist bool, valueInMap interface{}, newValue interface{}) int
 
 // Insert or Update - updates existing element or inserts a new one using UpsertCb
 func (m *ConcurrentHashMap) Upsert(key string, value interface{}, cb UpsertCb) (res interface{}) {
-	shard := m.GetShard(key)
-	shard.Lock()
+	shard := m.lockShard(key)
 	v, ok := shard.items[key]
 	res = cb(ok, v, value)
-	shard.items[key] = res
-	shard.Unlock()
+	m.store(shard, key, res)
+	shard.unlock()
 	return res
 }
 
+// Upsert for every element of data, every shard involved is locked only once
+// and cb is called for each of its keys in turn.
+func (m *ConcurrentHashMap) MUpsert(data map[string]interface{}, cb UpsertCb) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	t := m.loadTable()
+	for idx, group := range t.groupByShard(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.lock()
+		for _, key := range group {
+			v, ok := shard.items[key]
+			m.store(shard, key, cb(ok, v, data[key]))
+		}
+		shard.unlock()
+	}
+}
+
+// Callback deciding the new element under a key from the current one,
+// returning store as false leaves the map untouched.
+// It is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant
+type UpsertTxCb func(exists bool, current interface{}) (newValue interface{}, store bool)
+
+// Insert or Update which may be aborted - stores the value returned by cb unless
+// cb asks not to, in which case the current value is returned instead.
+// The boolean reports whether a write occurred.
+func (m *ConcurrentHashMap) UpsertTx(key string, cb UpsertTxCb) (interface{}, bool) {
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	current, ok := shard.items[key]
+	v, store := cb(ok, current)
+	if !store {
+		return current, false
+	}
+	m.store(shard, key, v)
+	return v, true
+}
+
 // Sets the given value under the specified key if no value was associated with it.
 func (m *ConcurrentHashMap) SetIfAbsent(key string, value interface{}) bool {
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
+	shard := m.lockShard(key)
 	_, ok := shard.items[key]
 	if !ok {
-		shard.items[key] = value
+		m.store(shard, key, value)
+	}
+	shard.unlock()
+	return !ok
+}
+
+// Sets the value returned by fn under the specified key if no value was
+// associated with it, fn is only called in that case. Returns whether fn was
+// called and its value stored. fn is called while lock is held, therefore it
+// MUST NOT try to access other keys in same map, as it can lead to deadlock
+// since Go sync.RWLock is not reentrant
+func (m *ConcurrentHashMap) SetIfAbsentFunc(key string, fn func() interface{}) (stored bool) {
+	// Get map shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	if _, ok := shard.items[key]; ok {
+		return false
+	}
+	m.store(shard, key, fn())
+	return true
+}
+
+// Retrieves an element from map under given key.
+// nil is a value like any other: a key set to nil yields nil, true while a
+// missing key yields nil, false, so check the boolean rather than the value.
+func (m *ConcurrentHashMap) Get(key string) (interface{}, bool) {
+	// Get shard
+	shard := m.GetShard(key)
+	if shard.readOptimized {
+		// Read optimized shards are read without locking, unless key may
+		// not be published yet. unpublished is loaded first, it is only
+		// cleared after the entries holding the new keys were published.
+		unpublished := shard.unpublished.Load()
+		entries := shard.view()
+		if e := entries[key]; e != nil || !unpublished {
+			var val interface{}
+			var p *interface{}
+			if e != nil {
+				p = e.p.Load()
+			}
+			ok := p != nil
+			if ok {
+				val = *p
+			}
+			if o := m.observer.Load(); o != nil {
+				(*o).OnGet(key, ok)
+			}
+			return val, ok
+		}
+		shard.rlock()
+		val, ok := m.readAndUnlock(shard, key)
+		// Publish the new keys once the lookups under the lock cost about
+		// as much as copying the entries.
+		if shard.misses.Add(1) > int64(len(entries)) {
+			shard.lock()
+			if shard.unpublished.Load() {
+				shard.publish()
+			}
+			shard.unlock()
+		}
+		return val, ok
+	}
+	shard.rlock()
+	return m.readAndUnlock(shard, key)
+}
+
+// Retrieves an element from the read locked shard and unlocks it,
+// counting the access and notifying the observer.
+func (m *ConcurrentHashMap) readAndUnlock(shard *ConcurrentMapShared, key string) (interface{}, bool) {
+	// Get item from shard.
+	val, ok := shard.items[key]
+	firstHit := false
+	if ok && shard.hits != nil {
+		if hits := shard.hits[key]; hits != nil {
+			hits.Add(1)
+		} else {
+			firstHit = true
+		}
+	}
+	shard.runlock()
+	if firstHit {
+		m.addHit(key)
+	}
+	if o := m.observer.Load(); o != nil {
+		(*o).OnGet(key, ok)
+	}
+	return val, ok
+}
+
+// Retrieves an element from map under given key, or def if there is none.
+func (m *ConcurrentHashMap) GetDefault(key string, def interface{}) interface{} {
+	if v, ok := m.Get(key); ok {
+		return v
+	}
+	return def
+}
+
+// Returned by GetOrError for missing keys.
+var ErrKeyNotFound = errors.New("cmap: key not found")
+
+// Retrieves an element from map under given key, returning an error wrapping
+// ErrKeyNotFound if there is none, for code propagating errors rather than
+// checking booleans. A key set to nil yields nil, nil.
+func (m *ConcurrentHashMap) GetOrError(key string) (interface{}, error) {
+	v, ok := m.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	return v, nil
+}
+
+// Retrieves the string under given key, the boolean is false if the key is
+// missing or the stored value is not a string.
+func (m *ConcurrentHashMap) GetString(key string) (string, bool) {
+	v, _ := m.Get(key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+// Retrieves the int under given key, the boolean is false if the key is
+// missing or the stored value is not an int. Other integer types, e.g. int64,
+// don't match.
+func (m *ConcurrentHashMap) GetInt(key string) (int, bool) {
+	v, _ := m.Get(key)
+	i, ok := v.(int)
+	return i, ok
+}
+
+// Retrieves the bool under given key, the second boolean is false if the key
+// is missing or the stored value is not a bool.
+func (m *ConcurrentHashMap) GetBool(key string) (bool, bool) {
+	v, _ := m.Get(key)
+	b, ok := v.(bool)
+	return b, ok
+}
+
+// Counts a Get of key which has no counter yet, creating the counter
+// requires the shard's write lock.
+func (m *ConcurrentHashMap) addHit(key string) {
+	shard := m.lockShard(key)
+	if _, ok := shard.items[key]; ok {
+		hits := shard.hits[key]
+		if hits == nil {
+			hits = new(atomic.Int64)
+			shard.hits[key] = hits
+		}
+		hits.Add(1)
+	}
+	shard.unlock()
+}
+
+// Number of Get calls for a key, as reported by HotKeys.
+type KeyCount struct {
+	Key   string
+	Count int64
+}
+
+// Returns the n keys read most often by Get, most accessed first.
+// Counts are only kept for maps created with Options.TrackAccess,
+// HotKeys returns nil for other maps, and for n <= 0. A key's count is reset
+// when it is removed.
+func (m *ConcurrentHashMap) HotKeys(n int) []KeyCount {
+	if n <= 0 {
+		return nil
+	}
+	counts := make([]KeyCount, 0)
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		for key, hits := range shard.hits {
+			counts = append(counts, KeyCount{key, hits.Load()})
+		}
+		shard.runlock()
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if n < len(counts) {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// Returns the number of elements within the map.
+func (m *ConcurrentHashMap) Count() int {
+	count := 0
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		count += len(shard.items)
+		shard.runlock()
+	}
+	return count
+}
+
+// Returns the number of elements for which pred returns true, without
+// collecting them like Filter. Shards are scanned one at a time under read lock,
+// therefore pred MUST NOT access the map, not even to read it.
+func (m *ConcurrentHashMap) CountWhere(pred func(key string, v interface{}) bool) int {
+	count := 0
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		for key, value := range shard.items {
+			if pred(key, value) {
+				count++
+			}
+		}
+		shard.runlock()
+	}
+	return count
+}
+
+// Parallel counterpart of CountWhere, pred is evaluated by one goroutine per
+// shard, which pays off for expensive predicates over large maps.
+// pred may be called from several goroutines at once, and MUST NOT access
+// the map, not even to read it.
+func (m *ConcurrentHashMap) CountWhereConcurrent(pred func(key string, v interface{}) bool) int {
+	shards := m.loadTable().shards
+	var count atomic.Int64
+	var wg sync.WaitGroup
+
+	wg.Add(len(shards))
+	for _, shard := range shards {
+		go func(shard *ConcurrentMapShared) {
+			defer wg.Done()
+			n := 0
+			shard.rlock()
+			for key, value := range shard.items {
+				if pred(key, value) {
+					n++
+				}
+			}
+			shard.runlock()
+			count.Add(int64(n))
+		}(shard)
+	}
+	wg.Wait()
+	return int(count.Load())
+}
+
+// Returns the number of elements within the map in O(1), without locking any shard.
+// Unlike Count it reads a counter maintained by the map methods, so it may lag
+// behind writes which are still in progress, and doesn't see elements
+// inserted by accessing the shards directly.
+func (m *ConcurrentHashMap) Len() int {
+	// Counts the elements of adopted shards.
+	m.loadTable()
+	return int(m.size.Load())
+}
+
+// Returns the number of elements within every shard, in shard index order.
+func (m *ConcurrentHashMap) ShardCounts() []int {
+	shards := m.loadTable().shards
+	counts := make([]int, len(shards))
+	for i, shard := range shards {
+		shard.rlock()
+		counts[i] = len(shard.items)
+		shard.runlock()
+	}
+	return counts
+}
+
+// Snapshot of the map's health, as returned by Stats.
+type Stats struct {
+	Count       int
+	ShardCounts []int
+	Ops         *OpCounts `json:",omitempty"` // Set when the observer is an *OpCounters.
+}
+
+// Returns the number of elements, the number of elements within every shard
+// and, if an *OpCounters is installed with SetObserver, its operation counters.
+// Every shard is read locked once. Stats is a plain value, safe to marshal to JSON.
+func (m *ConcurrentHashMap) Stats() Stats {
+	stats := Stats{ShardCounts: m.ShardCounts()}
+	for _, c := range stats.ShardCounts {
+		stats.Count += c
+	}
+	if o := m.observer.Load(); o != nil {
+		if counters, ok := (*o).(*OpCounters); ok {
+			counts := counters.Counts()
+			stats.Ops = &counts
+		}
+	}
+	return stats
+}
+
+// Lock statistics of a shard, as reported by ContentionStats.
+type ShardContention struct {
+	Acquired  int64 // Number of times the shard was locked, for reading or writing.
+	Contended int64 // Number of those which had to wait for another goroutine.
+}
+
+// Returns the lock statistics of every shard, in shard index order, for maps
+// created with Options.TrackContention, nil for other maps. A high share of
+// contended acquisitions suggests using more shards. Resize starts over
+// with fresh statistics.
+func (m *ConcurrentHashMap) ContentionStats() []ShardContention {
+	shards := m.loadTable().shards
+	if len(shards) == 0 || shards[0].contention == nil {
+		return nil
+	}
+	stats := make([]ShardContention, len(shards))
+	for i, shard := range shards {
+		stats[i] = ShardContention{shard.contention.acquired.Load(), shard.contention.contended.Load()}
 	}
-	shard.Unlock()
-	return !ok
+	return stats
 }
 
-// Retrieves an element from map under given key.
-func (m *ConcurrentHashMap) Get(key string) (interface{}, bool) {
-	// Get shard
-	shard := m.GetShard(key)
-	shard.RLock()
-	// Get item from shard.
-	val, ok := shard.items[key]
-	shard.RUnlock()
-	return val, ok
+// Returns the minimum, maximum, mean and standard deviation of ShardCounts,
+// a large deviation hints at a poor Shards value or skewed keys.
+func (m *ConcurrentHashMap) ShardLoadStats() (min, max int, mean, stddev float64) {
+	return loadStats(m.ShardCounts())
 }
 
-// Returns the number of elements within the map.
-func (m *ConcurrentHashMap) Count() int {
-	count := 0
-	for i := 0; i < m.Shards; i++ {
-		shard := m.HashMap[i]
-		shard.RLock()
-		count += len(shard.items)
-		shard.RUnlock()
+func loadStats(counts []int) (min, max int, mean, stddev float64) {
+	if len(counts) == 0 {
+		return 0, 0, 0, 0
 	}
-	return count
+	min, max = counts[0], counts[0]
+	total := 0
+	for _, c := range counts {
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+		total += c
+	}
+	mean = float64(total) / float64(len(counts))
+	for _, c := range counts {
+		d := float64(c) - mean
+		stddev += d * d
+	}
+	stddev = math.Sqrt(stddev / float64(len(counts)))
+	return min, max, mean, stddev
+}
+
+// How keys would spread across shards, as computed by AnalyzeDistribution.
+type DistributionReport struct {
+	Counts   []int   // Number of keys per shard, in shard index order.
+	Min, Max int     // Smallest and largest shard.
+	Mean     float64 // Average number of keys per shard.
+	StdDev   float64 // Standard deviation of Counts.
+	Skew     float64 // Max divided by Mean, 1 for a perfect spread, 0 without keys.
+}
+
+// Computes how keys would spread across a map created with New(shards),
+// without building the map, e.g. to pick Shards from a sample of real keys.
+// Keys are placed exactly like the map does. Panics with ErrInvalidShards
+// if shards < 1.
+func AnalyzeDistribution(keys []string, shards int) DistributionReport {
+	if shards <= 0 {
+		panic(ErrInvalidShards)
+	}
+	r := DistributionReport{Counts: make([]int, shards)}
+	for _, key := range keys {
+		r.Counts[shardOf(fnv32(key), shards)]++
+	}
+	r.Min, r.Max, r.Mean, r.StdDev = loadStats(r.Counts)
+	if r.Mean > 0 {
+		r.Skew = float64(r.Max) / r.Mean
+	}
+	return r
 }
 
-// Looks up an item under specified key
+// Looks up an item under specified key, a key set to nil is present.
 func (m *ConcurrentHashMap) Has(key string) bool {
 	// Get shard
 	shard := m.GetShard(key)
-	shard.RLock()
+	shard.rlock()
 	// See if element is within shard.
 	_, ok := shard.items[key]
-	shard.RUnlock()
+	shard.runlock()
 	return ok
 }
 
+// Reports whether every given key is in the map, true if no key is given.
+// Shards are read locked once each, and no further shard is locked
+// after the first missing key.
+func (m *ConcurrentHashMap) HasAll(keys ...string) bool {
+	return !m.hasKeys(keys, false)
+}
+
+// Reports whether any given key is in the map, false if no key is given.
+// Shards are read locked once each, and no further shard is locked
+// after the first key found.
+func (m *ConcurrentHashMap) HasAny(keys ...string) bool {
+	return m.hasKeys(keys, true)
+}
+
+// Reports whether the presence of some key equals want,
+// stopping at the first such key.
+func (m *ConcurrentHashMap) hasKeys(keys []string, want bool) bool {
+	t := m.loadTable()
+	for idx, group := range t.groupByShard(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.rlock()
+		for _, key := range group {
+			if _, ok := shard.items[key]; ok == want {
+				shard.runlock()
+				return true
+			}
+		}
+		shard.runlock()
+	}
+	return false
+}
+
 // Removes an element from the map.
 func (m *ConcurrentHashMap) Remove(key string) {
 	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	delete(shard.items, key)
-	shard.Unlock()
+	shard := m.lockShard(key)
+	m.remove(shard, key)
+	shard.unlock()
 }
 
 // Removes an element from the map and returns it
 func (m *ConcurrentHashMap) Pop(key string) (v interface{}, exists bool) {
 	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	v, exists = shard.items[key]
-	delete(shard.items, key)
-	shard.Unlock()
+	shard := m.lockShard(key)
+	v, exists = m.remove(shard, key)
+	shard.unlock()
+	return v, exists
+}
+
+// Removes an element from the map and returns it like Pop, if it existed
+// onRemove is called with the removed value before the shard is unlocked,
+// so cleanup runs exactly when the element leaves the map. onRemove is called
+// while lock is held, therefore it MUST NOT try to access other keys in same map.
+func (m *ConcurrentHashMap) PopWithCleanup(key string, onRemove func(v interface{})) (v interface{}, exists bool) {
+	// Try to get shard.
+	shard := m.lockShard(key)
+	func() {
+		defer shard.unlock()
+		if v, exists = m.remove(shard, key); exists {
+			onRemove(v)
+		}
+	}()
 	return v, exists
 }
 
@@ -143,6 +1521,102 @@ func (m *ConcurrentHashMap) IsEmpty() bool {
 	return m.Count() == 0
 }
 
+// Removes every element of the write locked shard, keeping the map's
+// counters in line and notifying watchers.
+func (m *ConcurrentHashMap) resetShard(shard *ConcurrentMapShared) {
+	m.size.Add(-int64(len(shard.items)))
+	for _, size := range shard.sizes {
+		m.sizeSum.Add(-int64(size))
+	}
+	m.notifyReset(shard)
+	if o := m.observer.Load(); o != nil {
+		for key := range shard.items {
+			shard.observed = append(shard.observed, pendingOp{*o, key, true})
+		}
+	}
+	shard.reset()
+}
+
+// Removes all elements from the map.
+// Shards are locked and emptied one at a time, the shard layout itself
+// is left untouched.
+func (m *ConcurrentHashMap) Clear() {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	for _, shard := range m.loadTable().shards {
+		shard.lock()
+		m.resetShard(shard)
+		shard.unlock()
+	}
+}
+
+// Removes all elements from the map and returns them, e.g. to flush
+// a buffer map downstream. Like Clear, shards are emptied one at a time.
+func (m *ConcurrentHashMap) PopAll() map[string]interface{} {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	shards := m.loadTable().shards
+	drained := make([]map[string]interface{}, len(shards))
+	total := 0
+	for i, shard := range shards {
+		shard.lock()
+		drained[i] = shard.items
+		m.resetShard(shard)
+		shard.unlock()
+		total += len(drained[i])
+	}
+
+	tmp := make(map[string]interface{}, total)
+	for _, items := range drained {
+		for key, value := range items {
+			tmp[key] = value
+		}
+	}
+	return tmp
+}
+
+// Removes all elements from the map and sends them to out, blocking while
+// out is full, so a consumer applies backpressure rather than PopAll buffering
+// everything. Shards are drained one after the other: a shard's elements are
+// removed in one step under its lock and then sent, every removed element is
+// sent exactly once. Elements written to a shard after it was drained stay in
+// the map. out is not closed.
+func (m *ConcurrentHashMap) DrainInto(out chan<- Tuple) {
+	t := m.loadTable()
+	for i := 0; i < len(t.shards); i++ {
+		shard := t.shards[i]
+		shard.lock()
+		if shard.retired {
+			// Resize moved the remaining elements, start over on the new shards.
+			shard.unlock()
+			t = m.loadTable()
+			i = -1
+			continue
+		}
+		items := shard.items
+		m.resetShard(shard)
+		shard.unlock()
+
+		for key, value := range items {
+			out <- Tuple{key, value}
+		}
+	}
+}
+
+// Releases the memory Go maps keep after many deletions, by copying every
+// shard's elements into a map sized to fit them.
+// This is a deliberate maintenance operation, e.g. after a large eviction:
+// every element is copied and each shard stays locked while it is copied.
+func (m *ConcurrentHashMap) TrimShards() {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	for _, shard := range m.loadTable().shards {
+		shard.lock()
+		shard.trim()
+		shard.unlock()
+	}
+}
+
 // Used by the Iter & IterBuffered functions to wrap two variables together over a channel,
 type Tuple struct {
 	Key string
@@ -150,6 +1624,8 @@ type Tuple struct {
 }
 
 // Returns an iterator which could be used in a for range loop.
+// Its goroutines block until the channel is drained, use IterWithStop
+// when the loop may be abandoned.
 //
 // Deprecated: using IterBuffered() will get a better performence
 func (m *ConcurrentHashMap) Iter() <-chan Tuple {
@@ -171,25 +1647,86 @@ func (m *ConcurrentHashMap) IterBuffered() <-chan Tuple {
 	return ch
 }
 
+// Returns a buffered iterator which yields the elements in ascending key order.
+// Every element is copied and sorted before the first one is sent,
+// shards are copied one after the other, like Items.
+func (m *ConcurrentHashMap) IterSorted() <-chan Tuple {
+	tuples := m.sortedTuples()
+	ch := make(chan Tuple, len(tuples))
+	for _, tuple := range tuples {
+		ch <- tuple
+	}
+	close(ch)
+	return ch
+}
+
+// Copies every element, shard by shard, and sorts them by key.
+func (m *ConcurrentHashMap) sortedTuples() []Tuple {
+	tuples := make([]Tuple, 0, m.Len())
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		for key, val := range shard.items {
+			tuples = append(tuples, Tuple{key, val})
+		}
+		shard.runlock()
+	}
+	sort.Slice(tuples, func(i, j int) bool { return tuples[i].Key < tuples[j].Key })
+	return tuples
+}
+
+// Tuple tagged with the index of the shard it was read from, see IterWithShard.
+type ShardTuple struct {
+	Tuple
+	Shard int
+}
+
+// Returns a buffered iterator like IterBuffered, each element is tagged with
+// the index of its shard, e.g. to check how keys spread across shards or to
+// process the map shard by shard.
+func (m *ConcurrentHashMap) IterWithShard() <-chan ShardTuple {
+	chans := snapshot(m)
+	total := 0
+	for _, c := range chans {
+		total += cap(c)
+	}
+	ch := make(chan ShardTuple, total)
+	go func() {
+		wg := sync.WaitGroup{}
+		wg.Add(len(chans))
+		for index, c := range chans {
+			go func(index int, c chan Tuple) {
+				for t := range c {
+					ch <- ShardTuple{t, index}
+				}
+				wg.Done()
+			}(index, c)
+		}
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
 // Returns a array of channels that contains elements in each shard,
 // which likely takes a snapshot of `m`.
 // It returns once the size of each buffered channel is determined,
 // before all the channels are populated using goroutines.
 func snapshot(m *ConcurrentHashMap) (chans []chan Tuple) {
-	chans = make([]chan Tuple, m.Shards)
+	shards := m.loadTable().shards
+	chans = make([]chan Tuple, len(shards))
 	wg := sync.WaitGroup{}
-	wg.Add(m.Shards)
+	wg.Add(len(shards))
 	// Foreach shard.
-	for index, shard := range m.HashMap {
+	for index, shard := range shards {
 		go func(index int, shard *ConcurrentMapShared) {
 			// Foreach key, value pair.
-			shard.RLock()
+			shard.rlock()
 			chans[index] = make(chan Tuple, len(shard.items))
 			wg.Done()
 			for key, val := range shard.items {
 				chans[index] <- Tuple{key, val}
 			}
-			shard.RUnlock()
+			shard.runlock()
 			close(chans[index])
 		}(index, shard)
 	}
@@ -213,9 +1750,55 @@ func fanIn(chans []chan Tuple, out chan Tuple) {
 	close(out)
 }
 
+// Returns an iterator which could be used in a for range loop.
+// Once ctx is done the iterator goroutines stop and the channel is closed,
+// so a loop abandoned midway doesn't leak goroutines.
+func (m *ConcurrentHashMap) IterWithContext(ctx context.Context) <-chan Tuple {
+	chans := snapshot(m)
+	ch := make(chan Tuple)
+	go fanInContext(ctx, chans, ch)
+	return ch
+}
+
+// Returns an iterator which could be used in a for range loop, along with
+// a func tearing it down: once called, the iterator goroutines stop and
+// the channel is closed, so breaking out of the loop doesn't leak them.
+// The func may be called more than once.
+func (m *ConcurrentHashMap) IterWithStop() (<-chan Tuple, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return m.IterWithContext(ctx), cancel
+}
+
+// fanInContext is fanIn giving up on sending as soon as ctx is done.
+func fanInContext(ctx context.Context, chans []chan Tuple, out chan Tuple) {
+	wg := sync.WaitGroup{}
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		go func(ch chan Tuple) {
+			defer wg.Done()
+			for t := range ch {
+				select {
+				case out <- t:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ch)
+	}
+	wg.Wait()
+	close(out)
+}
+
 // Returns a buffered iterator which could be used in a for range loop.
 func (m *ConcurrentHashMap) IterBufferedLike(k string) <-chan Tuple {
-	chans := snapshotlike(m, k)
+	return m.iterBufferedMatch(func(key string) bool {
+		return strings.Contains(key, k)
+	})
+}
+
+// Returns a buffered iterator over the items whose key satisfies match.
+func (m *ConcurrentHashMap) iterBufferedMatch(match func(key string) bool) <-chan Tuple {
+	chans := snapshotMatch(m, match)
 	total := 0
 	for _, c := range chans {
 		total += cap(c)
@@ -225,18 +1808,115 @@ func (m *ConcurrentHashMap) IterBufferedLike(k string) <-chan Tuple {
 	return ch
 }
 
-// Returns all items as map[string]interface{}
-func (m *ConcurrentHashMap) ItemsLike(like string) map[string]interface{} {
+// Returns all items whose key satisfies match as map[string]interface{}
+func (m *ConcurrentHashMap) itemsMatch(match func(key string) bool) map[string]interface{} {
 	tmp := make(map[string]interface{})
 
 	// Insert items to temporary map.
-	for item := range m.IterBufferedLike(like) {
+	for item := range m.iterBufferedMatch(match) {
 		tmp[item.Key] = item.Val
 	}
 
 	return tmp
 }
 
+// Returns all items whose key contains like as map[string]interface{}
+func (m *ConcurrentHashMap) ItemsLike(like string) map[string]interface{} {
+	return m.itemsMatch(func(key string) bool {
+		return strings.Contains(key, like)
+	})
+}
+
+// Matching options of ItemsLikeOpts.
+type LikeOptions struct {
+	CaseInsensitive bool // Compare keys and pattern once both are lowered by strings.ToLower.
+	Anchored        bool // Match only keys starting with the pattern.
+}
+
+// Returns all items whose key contains pattern as map[string]interface{},
+// like ItemsLike but with the matching tuned by opts. Anchored matching only
+// compares the start of every key, which is cheaper than a substring search.
+func (m *ConcurrentHashMap) ItemsLikeOpts(pattern string, opts LikeOptions) map[string]interface{} {
+	var match func(key string) bool
+	switch {
+	case opts.Anchored && opts.CaseInsensitive:
+		lower := strings.ToLower(pattern)
+		match = func(key string) bool {
+			return strings.HasPrefix(strings.ToLower(key), lower)
+		}
+	case opts.Anchored:
+		match = func(key string) bool {
+			return strings.HasPrefix(key, pattern)
+		}
+	case opts.CaseInsensitive:
+		lower := strings.ToLower(pattern)
+		match = func(key string) bool {
+			return strings.Contains(strings.ToLower(key), lower)
+		}
+	default:
+		match = func(key string) bool {
+			return strings.Contains(key, pattern)
+		}
+	}
+	return m.itemsMatch(match)
+}
+
+// Returns all items whose key starts with prefix as map[string]interface{}
+func (m *ConcurrentHashMap) ItemsPrefix(prefix string) map[string]interface{} {
+	return m.itemsMatch(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// Returns all items whose key lies lexicographically within [lo, hi]
+// as map[string]interface{}, e.g. RangeBetween("2023-01", "2023-02").
+func (m *ConcurrentHashMap) RangeBetween(lo, hi string) map[string]interface{} {
+	return m.itemsMatch(func(key string) bool {
+		return lo <= key && key <= hi
+	})
+}
+
+// Returns all items whose key matches re as map[string]interface{}.
+// re is compiled once by the caller and shared by the shard goroutines,
+// which is safe as regexp.Regexp is safe for concurrent use.
+func (m *ConcurrentHashMap) ItemsRegex(re *regexp.Regexp) map[string]interface{} {
+	return m.itemsMatch(re.MatchString)
+}
+
+// Returns all items for which pred returns true as map[string]interface{}.
+// Shards are scanned concurrently, each one under its read lock,
+// so pred may be called from several goroutines at once. pred MUST NOT
+// access the map, not even to read it.
+func (m *ConcurrentHashMap) Filter(pred func(key string, v interface{}) bool) map[string]interface{} {
+	shards := m.loadTable().shards
+	matches := make([][]Tuple, len(shards))
+	wg := sync.WaitGroup{}
+	wg.Add(len(shards))
+	// Foreach shard.
+	for index, shard := range shards {
+		go func(index int, shard *ConcurrentMapShared) {
+			// Foreach key, value pair.
+			shard.rlock()
+			for key, val := range shard.items {
+				if pred(key, val) {
+					matches[index] = append(matches[index], Tuple{key, val})
+				}
+			}
+			shard.runlock()
+			wg.Done()
+		}(index, shard)
+	}
+	wg.Wait()
+
+	tmp := make(map[string]interface{})
+	for _, tuples := range matches {
+		for _, t := range tuples {
+			tmp[t.Key] = t.Val
+		}
+	}
+	return tmp
+}
+
 // Returns all items as map[string]interface{}
 func (m *ConcurrentHashMap) Items() map[string]interface{} {
 	tmp := make(map[string]interface{})
@@ -249,6 +1929,74 @@ func (m *ConcurrentHashMap) Items() map[string]interface{} {
 	return tmp
 }
 
+// Returns all items as map[string]interface{}, like Items but copying every
+// shard directly under its read lock, without goroutines or channels.
+func (m *ConcurrentHashMap) ToMap() map[string]interface{} {
+	tmp := make(map[string]interface{}, m.Count())
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		for key, value := range shard.items {
+			tmp[key] = value
+		}
+		shard.runlock()
+	}
+	return tmp
+}
+
+// Returns a new sync.Map holding every element, e.g. while migrating code
+// between both. Like ToMap, shards are copied one after the other.
+func (m *ConcurrentHashMap) ToSyncMap() *sync.Map {
+	tmp := &sync.Map{}
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		for key, value := range shard.items {
+			tmp.Store(key, value)
+		}
+		shard.runlock()
+	}
+	return tmp
+}
+
+// Creates a new concurrent map holding every entry of src. Entries stored or
+// deleted in src while it is copied may or may not be seen, as with
+// sync.Map's Range. Entries whose key isn't a string are skipped.
+func FromSyncMap(src *sync.Map, shards int) *ConcurrentHashMap {
+	m := New(shards)
+	src.Range(func(key, value interface{}) bool {
+		if k, ok := key.(string); ok {
+			m.Set(k, value)
+		}
+		return true
+	})
+	return m
+}
+
+// Returns a copy of every element as it was at a single instant.
+// Items and ToMap copy one shard after the other, so they may return a state
+// the map never was in. SnapshotConsistent read locks every shard, in index
+// order, before copying anything, which blocks all writers until the copy
+// is done: it is much more expensive for a busy map.
+func (m *ConcurrentHashMap) SnapshotConsistent() map[string]interface{} {
+	shards := m.loadTable().shards
+	for _, shard := range shards {
+		shard.rlock()
+	}
+	count := 0
+	for _, shard := range shards {
+		count += len(shard.items)
+	}
+	tmp := make(map[string]interface{}, count)
+	for _, shard := range shards {
+		for key, value := range shard.items {
+			tmp[key] = value
+		}
+	}
+	for _, shard := range shards {
+		shard.runlock()
+	}
+	return tmp
+}
+
 // Iterator callback,called for every key,value found in
 // maps. RLock is held for all calls for a given shard
 // therefore callback sess consistent view of a shard,
@@ -256,51 +2004,246 @@ func (m *ConcurrentHashMap) Items() map[string]interface{} {
 type IterCb func(key string, v interface{})
 
 // Callback based iterator, cheapest way to read
-// all elements in a map.
+// all elements in a map. fn MUST NOT access the map, not even to read it,
+// as it can lead to deadlock since Go sync.RWLock is not reentrant,
+// use CopyIterCb for callbacks which do.
 func (m *ConcurrentHashMap) IterCb(fn IterCb) {
-	for idx := range m.HashMap {
-		shard := m.HashMap[idx]
-		shard.RLock()
+	shards := m.loadTable().shards
+	for idx := range shards {
+		shard := shards[idx]
+		shard.rlock()
 		for key, value := range shard.items {
 			fn(key, value)
 		}
-		shard.RUnlock()
+		shard.runlock()
+	}
+}
+
+// Callback based iterator like IterCb, but each shard is only read locked
+// while its elements are copied, fn is called afterwards on the copy.
+// Slow callbacks therefore don't block writers, and fn may even access the
+// map, at the cost of copying one shard at a time. Elements written to a
+// shard after it was copied may or may not be seen.
+func (m *ConcurrentHashMap) CopyIterCb(fn IterCb) {
+	var tuples []Tuple
+	for _, shard := range m.loadTable().shards {
+		shard.rlock()
+		tuples = tuples[:0]
+		for key, value := range shard.items {
+			tuples = append(tuples, Tuple{key, value})
+		}
+		shard.runlock()
+		for _, t := range tuples {
+			fn(t.Key, t.Val)
+		}
+	}
+}
+
+// Iterator callback like IterCb, returning false stops the iteration.
+type IterCbBreak func(key string, v interface{}) bool
+
+// Callback based iterator which stops as soon as fn returns false,
+// the current shard is unlocked and the remaining shards are not visited.
+// Iteration order, within and across shards, is unspecified.
+// Like for IterCb, fn MUST NOT access the map, not even to read it.
+func (m *ConcurrentHashMap) IterCbBreak(fn IterCbBreak) {
+	shards := m.loadTable().shards
+	for idx := range shards {
+		shard := shards[idx]
+		shard.rlock()
+		for key, value := range shard.items {
+			if !fn(key, value) {
+				shard.runlock()
+				return
+			}
+		}
+		shard.runlock()
 	}
 }
 
+// Callback based iterator like IterCb, with one goroutine per shard, so fn
+// may be called from several goroutines at once. fn MUST NOT access the map,
+// not even to read it.
 func (m *ConcurrentHashMap) IterConcurrentCb(fn IterCb) {
+	shards := m.loadTable().shards
 	var wg sync.WaitGroup
 
-	wg.Add(len(m.HashMap))
-	for _, shard := range m.HashMap {
+	wg.Add(len(shards))
+	for _, shard := range shards {
 		go func(wg *sync.WaitGroup, shard *ConcurrentMapShared) {
-			shard.RLock()
+			shard.rlock()
 			for key, value := range shard.items {
 				fn(key, value)
 			}
-			shard.RUnlock()
+			shard.runlock()
 			wg.Done()
 		}(&wg, shard)
 	}
 	wg.Wait()
 }
 
-// Return all keys as []string
-func (m *ConcurrentHashMap) Keys() []string {
-	count := m.Count()
-	ch := make(chan string, count)
+// Calls fn for every shard in index order with the shard's own items map,
+// while the shard is read locked. Unlike Items only one shard is held at a time,
+// which bounds memory when e.g. streaming the map to disk.
+// fn MUST NOT modify items nor keep a reference to it once it returns,
+// nor access the map, not even to read it.
+func (m *ConcurrentHashMap) ForEachShard(fn func(shardIndex int, items map[string]interface{})) {
+	for idx, shard := range m.loadTable().shards {
+		shard.rlock()
+		fn(idx, shard.items)
+		shard.runlock()
+	}
+}
+
+// Concurrent callback based iterator like IterConcurrentCb, once fn returns
+// false in any goroutine the other ones stop at their next element.
+// fn may be called from several goroutines at once, and may still be called
+// a few times by other goroutines after one of them returned false.
+// Returns once every goroutine stopped. fn MUST NOT access the map,
+// not even to read it.
+func (m *ConcurrentHashMap) IterConcurrentCbBreak(fn IterCbBreak) {
+	shards := m.loadTable().shards
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+
+	wg.Add(len(shards))
+	for _, shard := range shards {
+		go func(shard *ConcurrentMapShared) {
+			defer wg.Done()
+			if stop.Load() {
+				return
+			}
+			shard.rlock()
+			defer shard.runlock()
+			for key, value := range shard.items {
+				if stop.Load() {
+					return
+				}
+				if !fn(key, value) {
+					stop.Store(true)
+					return
+				}
+			}
+		}(shard)
+	}
+	wg.Wait()
+}
+
+// Return all keys as []string
+func (m *ConcurrentHashMap) Keys() []string {
+	shards := m.loadTable().shards
+	count := m.Count()
+	ch := make(chan string, count)
+	go func() {
+		// Foreach shard.
+		wg := sync.WaitGroup{}
+		wg.Add(len(shards))
+		for _, shard := range shards {
+			go func(shard *ConcurrentMapShared) {
+				// Foreach key, value pair.
+				shard.rlock()
+				for key := range shard.items {
+					ch <- key
+				}
+				shard.runlock()
+				wg.Done()
+			}(shard)
+		}
+		wg.Wait()
+		close(ch)
+	}()
+
+	// Generate keys
+	keys := make([]string, 0, count)
+	for k := range ch {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Return all values as []interface{}
+func (m *ConcurrentHashMap) Values() []interface{} {
+	shards := m.loadTable().shards
+	count := m.Count()
+	ch := make(chan interface{}, count)
+	go func() {
+		// Foreach shard.
+		wg := sync.WaitGroup{}
+		wg.Add(len(shards))
+		for _, shard := range shards {
+			go func(shard *ConcurrentMapShared) {
+				// Foreach key, value pair.
+				shard.rlock()
+				for _, value := range shard.items {
+					ch <- value
+				}
+				shard.runlock()
+				wg.Done()
+			}(shard)
+		}
+		wg.Wait()
+		close(ch)
+	}()
+
+	// Generate values
+	values := make([]interface{}, 0, count)
+	for v := range ch {
+		values = append(values, v)
+	}
+	return values
+}
+
+// Returns a channel yielding every key, e.g. to stream keys to a writer
+// without building a []string first, along with a func tearing it down like
+// IterWithStop's. Shards are walked one at a time and only the keys of the
+// current shard are copied, the shard isn't locked while keys are sent, so
+// the consumer may modify the map. Keys added or removed during the walk may
+// or may not be yielded.
+func (m *ConcurrentHashMap) KeysChan() (<-chan string, func()) {
+	shards := m.loadTable().shards
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan string, len(shards))
+	go func() {
+		defer close(out)
+		var keys []string
+		for _, shard := range shards {
+			shard.rlock()
+			keys = keys[:0]
+			for key := range shard.items {
+				keys = append(keys, key)
+			}
+			shard.runlock()
+			for _, key := range keys {
+				select {
+				case out <- key:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, cancel
+}
+
+// Return all keys starting with prefix as []string
+func (m *ConcurrentHashMap) KeysWithPrefix(prefix string) []string {
+	shards := m.loadTable().shards
+	// Keys are consumed while shards are walked, no need to size ch to Count.
+	ch := make(chan string, len(shards))
 	go func() {
 		// Foreach shard.
 		wg := sync.WaitGroup{}
-		wg.Add(m.Shards)
-		for _, shard := range m.HashMap {
+		wg.Add(len(shards))
+		for _, shard := range shards {
 			go func(shard *ConcurrentMapShared) {
 				// Foreach key, value pair.
-				shard.RLock()
+				shard.rlock()
 				for key := range shard.items {
-					ch <- key
+					if strings.HasPrefix(key, prefix) {
+						ch <- key
+					}
 				}
-				shard.RUnlock()
+				shard.runlock()
 				wg.Done()
 			}(shard)
 		}
@@ -309,23 +2252,131 @@ func (m *ConcurrentHashMap) Keys() []string {
 	}()
 
 	// Generate keys
-	keys := make([]string, 0, count)
+	keys := make([]string, 0)
 	for k := range ch {
 		keys = append(keys, k)
 	}
 	return keys
 }
 
+// Maximum number of elements printed by String.
+const stringLimit = 100
+
+// Returns a readable representation of the map for debugging, e.g.
+// "ConcurrentHashMap(count=2)[a=1 b=2]". Elements are sorted by key and
+// only the first 100 are printed, the rest is replaced by "...".
+func (m *ConcurrentHashMap) String() string {
+	tuples := m.sortedTuples()
+	var b strings.Builder
+	fmt.Fprintf(&b, "ConcurrentHashMap(count=%d)[", len(tuples))
+	for i, tuple := range tuples {
+		if i == stringLimit {
+			b.WriteString(" ...")
+			break
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%v", tuple.Key, tuple.Val)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// Converts a value to the form MarshalJSON encodes, see SetMarshalFunc.
+type MarshalFunc func(key string, v interface{}) (interface{}, error)
+
+// Installs fn to convert every value before MarshalJSON encodes it, e.g. for
+// values which aren't JSON friendly. An error returned by fn aborts MarshalJSON
+// with that error. A nil fn restores encoding values as is.
+func (m *ConcurrentHashMap) SetMarshalFunc(fn MarshalFunc) {
+	if fn == nil {
+		m.marshal.Store(nil)
+		return
+	}
+	m.marshal.Store(&fn)
+}
+
 //Reviles ConcurrentHashMap "private" variables to json marshal.
+// Elements come from SnapshotConsistent and are written sorted by key,
+// so equal maps always produce the same output.
 func (m *ConcurrentHashMap) MarshalJSON() ([]byte, error) {
-	// Create a temporary map, which will hold all item spread across shards.
+	tmp := m.SnapshotConsistent()
+	keys := make([]string, 0, len(tmp))
+	for key := range tmp {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fn := m.marshal.Load()
+
+	buf := bytes.NewBuffer(make([]byte, 0, 16*len(keys)+2))
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		val := tmp[key]
+		if fn != nil {
+			if val, err = (*fn)(key, val); err != nil {
+				return nil, err
+			}
+		}
+		v, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Populates ConcurrentHashMap from a JSON object, existing elements are kept
+// unless overwritten. A map without shards, e.g. a zero ConcurrentHashMap,
+// is first initialized with SHARDS_COUNT shards.
+func (m *ConcurrentHashMap) UnmarshalJSON(b []byte) error {
 	tmp := make(map[string]interface{})
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return err
+	}
 
-	// Insert items to temporary map.
-	for item := range m.IterBuffered() {
-		tmp[item.Key] = item.Val
+	m.MSet(tmp)
+	return nil
+}
+
+// Encodes every element with encoding/gob, unlike JSON concrete value types
+// survive a round trip. Value types must be registered with gob.Register.
+func (m *ConcurrentHashMap) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m.SnapshotConsistent()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Populates ConcurrentHashMap from GobEncode output, existing elements are kept
+// unless overwritten. A map without shards, e.g. a zero ConcurrentHashMap,
+// is first initialized with SHARDS_COUNT shards.
+func (m *ConcurrentHashMap) GobDecode(b []byte) error {
+	tmp := make(map[string]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&tmp); err != nil {
+		return err
 	}
-	return json.Marshal(tmp)
+
+	m.MSet(tmp)
+	return nil
+}
+
+// Maps a hash to one of shards shards. The modulo is taken on uint32, so a key's
+// shard is the same on every platform, whatever the width of uint.
+func shardOf(hash uint32, shards int) int {
+	return int(hash % uint32(shards))
 }
 
 func fnv32(key string) uint32 {
@@ -342,23 +2393,25 @@ func fnv32(key string) uint32 {
 // which likely takes a snapshot of `m`.
 // It returns once the size of each buffered channel is determined,
 // before all the channels are populated using goroutines.
-func snapshotlike(m *ConcurrentHashMap, like string) (chans []chan Tuple) {
-	chans = make([]chan Tuple, m.Shards)
+// Only the elements whose key satisfies match are sent.
+func snapshotMatch(m *ConcurrentHashMap, match func(key string) bool) (chans []chan Tuple) {
+	shards := m.loadTable().shards
+	chans = make([]chan Tuple, len(shards))
 	wg := sync.WaitGroup{}
-	wg.Add(m.Shards)
+	wg.Add(len(shards))
 	// Foreach shard.
-	for index, shard := range m.HashMap {
+	for index, shard := range shards {
 		go func(index int, shard *ConcurrentMapShared) {
 			// Foreach key, value pair.
-			shard.RLock()
+			shard.rlock()
 			chans[index] = make(chan Tuple, len(shard.items))
 			wg.Done()
 			for key, val := range shard.items {
-				if strings.Contains(key, like) {
+				if match(key) {
 					chans[index] <- Tuple{key, val}
 				}
 			}
-			shard.RUnlock()
+			shard.runlock()
 			close(chans[index])
 		}(index, shard)
 	}
@@ -367,59 +2420,814 @@ func snapshotlike(m *ConcurrentHashMap, like string) (chans []chan Tuple) {
 }
 
 // Sets the given value under the specified key if oldValue was associated with it.
+// Values are compared with ==, use SetIfPresentFunc for values which aren't comparable.
 func (m *ConcurrentHashMap) SetIfPresent(key string, newValue, oldValue interface{}) bool {
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
+	shard := m.lockShard(key)
 	val, ok := shard.items[key]
 	ok = ok && (val == oldValue)
 	if ok {
-		shard.items[key] = newValue
+		m.store(shard, key, newValue)
+	}
+	shard.unlock()
+	return ok
+}
+
+// Sets the given value under the specified key if it exists and eq reports
+// its current value as matching. eq is called while lock is held,
+// therefore it MUST NOT try to access other keys in same map.
+func (m *ConcurrentHashMap) SetIfPresentFunc(key string, newValue interface{}, eq func(current interface{}) bool) bool {
+	// Get map shard.
+	shard := m.lockShard(key)
+	val, ok := shard.items[key]
+	ok = ok && eq(val)
+	if ok {
+		m.store(shard, key, newValue)
 	}
-	shard.Unlock()
+	shard.unlock()
 	return ok
 }
 
 // Sets the given value under the specified key if oldValue was associated with it.
 func (m *ConcurrentHashMap) AddIfPresent(key string, value interface{}) bool {
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
+	shard := m.lockShard(key)
 	val, ok := shard.items[key]
 	if ok {
 		tmp := val.([]interface{})
 		tmp = append(tmp, value)
-		shard.items[key] = tmp
+		m.store(shard, key, tmp)
 	} else {
-		shard.items[key] = value
+		m.store(shard, key, value)
 	}
-	shard.Unlock()
+	shard.unlock()
 	return ok
 }
 
+// Returned by AppendValues when the key holds something else than a []interface{}.
+var ErrNotSlice = errors.New("cmap: value is not a []interface{}")
+
+// Appends values to the []interface{} under key, creating it if the key is
+// missing. Unlike AddIfPresent it doesn't panic when the key holds another
+// type: an error wrapping ErrNotSlice is returned and the map is left unchanged.
+func (m *ConcurrentHashMap) AppendValues(key string, values ...interface{}) error {
+	// Get map shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	val, ok := shard.items[key]
+	if !ok {
+		m.store(shard, key, append([]interface{}(nil), values...))
+		return nil
+	}
+	tmp, isSlice := val.([]interface{})
+	if !isSlice {
+		return fmt.Errorf("%w: %q holds %T", ErrNotSlice, key, val)
+	}
+	m.store(shard, key, append(tmp, values...))
+	return nil
+}
+
 // Sets the given value under the specified key if it exist with CALLBACK function in case partial update
 func (m *ConcurrentHashMap) UpdateCb(key string, value interface{}, cb UpsertCb) bool {
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
+	shard := m.lockShard(key)
 	v, ok := shard.items[key]
 	if ok {
 		res := cb(ok, v, value)
-		shard.items[key] = res
+		m.store(shard, key, res)
 	}
-	shard.Unlock()
+	shard.unlock()
 	return ok
 }
 
 // Sets the given value under the specified key if it exist.
 func (m *ConcurrentHashMap) Update(key string, value interface{}) bool {
 	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
+	shard := m.lockShard(key)
 	_, ok := shard.items[key]
 	if ok {
-		shard.items[key] = value
+		m.store(shard, key, value)
 	}
-	shard.Unlock()
+	shard.unlock()
 	return ok
 }
+
+// Returns the value stored under key if present (loaded is true),
+// otherwise stores and returns the given value (loaded is false).
+// actual is always the value associated with key once the call returns.
+func (m *ConcurrentHashMap) GetOrSet(key string, value interface{}) (actual interface{}, loaded bool) {
+	// Get map shard.
+	shard := m.lockShard(key)
+	actual, loaded = shard.items[key]
+	if !loaded {
+		m.store(shard, key, value)
+		actual = value
+	}
+	shard.unlock()
+	return actual, loaded
+}
+
+// Returns the value stored under key if present, otherwise stores and
+// returns the result of fn. The boolean reports whether fn was called.
+// fn is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant
+func (m *ConcurrentHashMap) GetOrCompute(key string, fn func() interface{}) (interface{}, bool) {
+	// Get map shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	if v, ok := shard.items[key]; ok {
+		return v, false
+	}
+	v := fn()
+	m.store(shard, key, v)
+	return v, true
+}
+
+// Stores value under key and returns the value it replaced, if any,
+// in a single step.
+func (m *ConcurrentHashMap) GetAndSet(key string, value interface{}) (previous interface{}, existed bool) {
+	// Get map shard.
+	shard := m.lockShard(key)
+	previous, existed = shard.items[key]
+	m.store(shard, key, value)
+	shard.unlock()
+	return previous, existed
+}
+
+// Calls fn with the items map of the shard owning key while that shard is
+// write locked, so several keys living in the same shard (see ShardIndex)
+// can be read and modified atomically together.
+// fn may only insert keys whose ShardIndex equals that of key, other keys
+// couldn't be found by Get nor removed by Remove. This isn't checked, as it
+// would take a scan of the whole shard on every call.
+// fn MUST NOT call any method of the map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant, nor keep a reference to items once it returns.
+// Changes made by fn don't bump versions, see SetVersioned.
+func (m *ConcurrentHashMap) WithShardLock(key string, fn func(items map[string]interface{})) {
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	// fn may change any value, the shard is published anew.
+	shard.stale = true
+	before := len(shard.items)
+	fn(shard.items)
+	m.size.Add(int64(len(shard.items) - before))
+	for key := range shard.hits {
+		if _, ok := shard.items[key]; !ok {
+			delete(shard.hits, key)
+		}
+	}
+	for key := range shard.versions {
+		if _, ok := shard.items[key]; !ok {
+			delete(shard.versions, key)
+		}
+	}
+	for key := range shard.sizes {
+		if _, ok := shard.items[key]; !ok {
+			m.dropSize(shard, key)
+		}
+	}
+}
+
+// Same as WithShardLock, the write locked counterpart of WithReadLock.
+// fn may only insert keys whose ShardIndex equals that of key.
+func (m *ConcurrentHashMap) WithWriteLock(key string, fn func(items map[string]interface{})) {
+	m.WithShardLock(key, fn)
+}
+
+// Calls fn with the items map of the shard owning key while that shard is
+// read locked, so several keys living in the same shard can be read together
+// consistently. fn MUST NOT modify items nor call any method of the map,
+// not even a read, nor keep a reference to items once it returns.
+func (m *ConcurrentHashMap) WithReadLock(key string, fn func(items map[string]interface{})) {
+	// Get shard
+	shard := m.GetShard(key)
+	shard.rlock()
+	defer shard.runlock()
+	fn(shard.items)
+}
+
+// Callback deciding whether the element under a key should be removed.
+// It is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant
+type RemoveCb func(value interface{}, exists bool) bool
+
+// Removes the element under key if cb returns true, cb is given the
+// current value and whether the key exists at all.
+// Returns whether an element was actually removed.
+func (m *ConcurrentHashMap) RemoveIf(key string, cb RemoveCb) bool {
+	// Try to get shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	v, ok := shard.items[key]
+	remove := cb(v, ok)
+	if remove && ok {
+		m.remove(shard, key)
+	}
+	return remove && ok
+}
+
+// Removes the element under key and returns it if cb returns true for its
+// current value, otherwise the map is left unchanged and nil, false is returned.
+// cb is not called for a missing key. It is called while lock is held,
+// therefore it MUST NOT try to access other keys in same map.
+func (m *ConcurrentHashMap) PopIf(key string, cb func(value interface{}) bool) (interface{}, bool) {
+	// Try to get shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	v, ok := shard.items[key]
+	if !ok || !cb(v) {
+		return nil, false
+	}
+	m.remove(shard, key)
+	return v, true
+}
+
+// Removes the element under key only if it is equal to oldValue,
+// returns whether it was removed. Values are compared with ==, so both
+// must be comparable, otherwise the comparison panics.
+func (m *ConcurrentHashMap) CompareAndRemove(key string, oldValue interface{}) bool {
+	// Try to get shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	if val, ok := shard.items[key]; !ok || val != oldValue {
+		return false
+	}
+	m.remove(shard, key)
+	return true
+}
+
+// Retrieves the elements under given keys, missing keys are absent
+// from the result. Every shard involved is read locked only once.
+func (m *ConcurrentHashMap) MGet(keys []string) map[string]interface{} {
+	tmp := make(map[string]interface{}, len(keys))
+	t := m.loadTable()
+	for idx, group := range t.groupByShard(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.rlock()
+		for _, key := range group {
+			if val, ok := shard.items[key]; ok {
+				tmp[key] = val
+			}
+		}
+		shard.runlock()
+	}
+	return tmp
+}
+
+// Retrieves the elements under given keys, values[i] and found[i] belong to
+// keys[i], a missing key has a nil value. Every shard involved is read locked only once.
+func (m *ConcurrentHashMap) GetOrdered(keys []string) (values []interface{}, found []bool) {
+	values = make([]interface{}, len(keys))
+	found = make([]bool, len(keys))
+	t := m.loadTable()
+	// Positions of the keys, grouped by shard.
+	groups := make([][]int, len(t.shards))
+	for i, key := range keys {
+		idx := t.index(key)
+		groups[idx] = append(groups[idx], i)
+	}
+	for idx, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.rlock()
+		for _, i := range group {
+			values[i], found[i] = shard.items[keys[i]]
+		}
+		shard.runlock()
+	}
+	return values, found
+}
+
+// Removes the elements under given keys, every shard involved is locked
+// only once. Returns the number of elements which existed and were removed.
+func (m *ConcurrentHashMap) MRemove(keys []string) int {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	removed := 0
+	t := m.loadTable()
+	for idx, group := range t.groupByShard(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.lock()
+		for _, key := range group {
+			if _, ok := m.remove(shard, key); ok {
+				removed++
+			}
+		}
+		shard.unlock()
+	}
+	return removed
+}
+
+// Removes the elements under given keys and returns them, missing keys are
+// absent from the result. Every shard involved is locked only once, which
+// makes claiming a batch of keys much cheaper than calling Pop for each.
+func (m *ConcurrentHashMap) MPop(keys []string) map[string]interface{} {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	tmp := make(map[string]interface{}, len(keys))
+	t := m.loadTable()
+	for idx, group := range t.groupByShard(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		shard := t.shards[idx]
+		shard.lock()
+		for _, key := range group {
+			if val, ok := m.remove(shard, key); ok {
+				tmp[key] = val
+			}
+		}
+		shard.unlock()
+	}
+	return tmp
+}
+
+// Removes every element for which pred returns true and returns the number
+// of removed elements. Shards are swept one after the other, each shard is
+// locked only while it is swept, so the result isn't a consistent view of the
+// whole map. pred is called while the lock is held, therefore it MUST NOT
+// try to access other keys in same map.
+func (m *ConcurrentHashMap) RemoveAll(pred func(key string, v interface{}) bool) int {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	removed := 0
+	var matched []string
+	for _, shard := range m.loadTable().shards {
+		shard.lock()
+		// Collect keys first, remove afterwards.
+		matched = matched[:0]
+		for key, value := range shard.items {
+			if pred(key, value) {
+				matched = append(matched, key)
+			}
+		}
+		for _, key := range matched {
+			m.remove(shard, key)
+		}
+		shard.unlock()
+		removed += len(matched)
+	}
+	return removed
+}
+
+// Returns a new map with the same number of shards holding a copy of every
+// element. Values are copied by reference (shallow copy), each shard is
+// read locked while it is copied.
+func (m *ConcurrentHashMap) Clone() *ConcurrentHashMap {
+	return m.CloneWith(nil)
+}
+
+// Same as Clone, except every value is copied by copyVal, e.g. to deep copy
+// pointers to mutable structs. Values are copied by reference if copyVal is nil.
+// copyVal is called while the shard is read locked, therefore it MUST NOT
+// access the map, not even to read it.
+func (m *ConcurrentHashMap) CloneWith(copyVal func(interface{}) interface{}) *ConcurrentHashMap {
+	t := m.loadTable()
+	clone := newMap(len(t.shards), t.hasher, t.opts)
+	clone.maxSize = m.maxSize
+	clone.capped = m.capped
+	clone.versioned.Store(m.versioned.Load())
+	for idx, shard := range t.shards {
+		shard.rlock()
+		items := make(map[string]interface{}, len(shard.items))
+		for key, value := range shard.items {
+			if copyVal != nil {
+				value = copyVal(value)
+			}
+			items[key] = value
+		}
+		if shard.versions != nil {
+			versions := make(map[string]uint64, len(shard.versions))
+			for key, version := range shard.versions {
+				versions[key] = version
+			}
+			clone.HashMap[idx].versions = versions
+		}
+		if shard.sizes != nil {
+			sizes := make(map[string]int, len(shard.sizes))
+			for key, size := range shard.sizes {
+				sizes[key] = size
+				clone.sizeSum.Add(int64(size))
+			}
+			clone.HashMap[idx].sizes = sizes
+		}
+		shard.runlock()
+		clone.HashMap[idx].items = items
+		clone.HashMap[idx].resetPeak()
+		clone.HashMap[idx].publish()
+		clone.size.Add(int64(len(items)))
+	}
+	return clone
+}
+
+// Inserts every element of other into m. When a key already exists in m
+// onConflict decides the resulting value, the incoming value wins if it is nil.
+// onConflict is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map.
+// other may have a different number of shards or hasher, unlike SwapContents
+// Merge doesn't need ShardsCompatible maps: elements are placed using m's own sharding.
+func (m *ConcurrentHashMap) Merge(other *ConcurrentHashMap, onConflict func(existing, incoming interface{}) interface{}) {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	t := m.loadTable()
+	for _, src := range other.loadTable().shards {
+		// Copy the source shard first, so m and other are never locked together.
+		src.rlock()
+		tuples := make([]Tuple, 0, len(src.items))
+		for key, val := range src.items {
+			tuples = append(tuples, Tuple{key, val})
+		}
+		src.runlock()
+
+		groups := make([][]Tuple, len(t.shards))
+		for _, tuple := range tuples {
+			idx := t.index(tuple.Key)
+			groups[idx] = append(groups[idx], tuple)
+		}
+		for idx, group := range groups {
+			if len(group) == 0 {
+				continue
+			}
+			shard := t.shards[idx]
+			shard.lock()
+			for _, tuple := range group {
+				if existing, ok := shard.items[tuple.Key]; ok && onConflict != nil {
+					tuple.Val = onConflict(existing, tuple.Val)
+				}
+				m.store(shard, tuple.Key, tuple.Val)
+			}
+			shard.unlock()
+		}
+	}
+}
+
+// Atomically adds delta to the integer stored under key and returns the new total,
+// which is stored as an int64. A missing key, or a value which is neither
+// an int64 nor an int, counts as 0.
+func (m *ConcurrentHashMap) IncrementInt(key string, delta int64) int64 {
+	// Get map shard.
+	shard := m.lockShard(key)
+	var total int64
+	switch v := shard.items[key].(type) {
+	case int64:
+		total = v
+	case int:
+		total = int64(v)
+	}
+	total += delta
+	m.store(shard, key, total)
+	shard.unlock()
+	return total
+}
+
+// Atomically adds delta to the float stored under key and returns the new total,
+// which is stored as a float64. A missing key, or a value which is not
+// a float64, counts as 0.
+func (m *ConcurrentHashMap) IncrementFloat(key string, delta float64) float64 {
+	// Get map shard.
+	shard := m.lockShard(key)
+	total, _ := shard.items[key].(float64)
+	total += delta
+	m.store(shard, key, total)
+	shard.unlock()
+	return total
+}
+
+// Callback computing the new element under a key from the current one,
+// returning delete as true removes the key instead.
+// It is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant
+type ComputeCb func(oldValue interface{}, loaded bool) (newValue interface{}, delete bool)
+
+// Atomically stores the value returned by fn under key, or removes the key
+// if fn asks for it. Returns the resulting value and whether the key exists afterwards.
+func (m *ConcurrentHashMap) Compute(key string, fn ComputeCb) (interface{}, bool) {
+	// Get map shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	old, loaded := shard.items[key]
+	v, del := fn(old, loaded)
+	if del {
+		m.remove(shard, key)
+		return nil, false
+	}
+	m.store(shard, key, v)
+	return v, true
+}
+
+// Source of every version, shared by all maps and never reset, so a version
+// is never handed out twice, not even after a key was removed or its map's
+// contents were swapped by SwapContents.
+var versionClock atomic.Uint64
+
+// Gives key a new version in the write locked shard,
+// if SetVersioned was ever used on the map.
+func (m *ConcurrentHashMap) bumpVersion(shard *ConcurrentMapShared, key string) {
+	if shard.versions == nil {
+		if !m.versioned.Load() {
+			return
+		}
+		shard.versions = make(map[string]uint64)
+	}
+	shard.versions[key] = versionClock.Add(1)
+}
+
+// Sets the given value under the specified key and returns its new version,
+// for optimistic concurrency with CompareVersionAndSet. Every later write of
+// the key, by any method, gives it a greater version. Versions keep growing
+// when a key is removed and set again, so a version taken before the removal
+// never matches again. The first call switches versioning on for the whole
+// map, elements written before it have no version until they are written again.
+func (m *ConcurrentHashMap) SetVersioned(key string, value interface{}) (version uint64) {
+	m.versioned.Store(true)
+	// Get map shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	m.store(shard, key, value)
+	return shard.versions[key]
+}
+
+// Retrieves an element from map under given key along with its version,
+// 0 if it has no version, i.e. it wasn't written since SetVersioned was
+// first used on the map.
+func (m *ConcurrentHashMap) GetVersioned(key string) (value interface{}, version uint64, ok bool) {
+	// Get shard
+	shard := m.GetShard(key)
+	shard.rlock()
+	value, ok = shard.items[key]
+	version = shard.versions[key]
+	shard.runlock()
+	return value, version, ok
+}
+
+// Sets newValue under key only if the key exists and its version is still
+// expectedVersion, which makes the version grow. Returns whether the value was set.
+// Elements without a version never match, not even version 0, as writes
+// to them can't be detected. Unlike SetIfPresent, values don't need to be comparable.
+func (m *ConcurrentHashMap) CompareVersionAndSet(key string, newValue interface{}, expectedVersion uint64) bool {
+	// Get map shard.
+	shard := m.lockShard(key)
+	defer shard.unlock()
+	version, tracked := shard.versions[key]
+	if _, ok := shard.items[key]; !ok || !tracked || version != expectedVersion {
+		return false
+	}
+	m.store(shard, key, newValue)
+	return true
+}
+
+// Sets the given value under the specified key along with its size, e.g. its
+// cost in bytes, which the map can't compute for interface{} values.
+// TotalSize sums the sizes of the current elements: overwriting or removing
+// an element subtracts its size, elements stored by other methods count as 0.
+func (m *ConcurrentHashMap) SetWithSize(key string, value interface{}, size int) {
+	// Get map shard.
+	shard := m.lockShard(key)
+	m.store(shard, key, value)
+	if shard.sizes == nil {
+		shard.sizes = make(map[string]int)
+	}
+	shard.sizes[key] = size
+	m.sizeSum.Add(int64(size))
+	shard.unlock()
+}
+
+// Returns the sum of the sizes given to SetWithSize for the current elements,
+// without locking any shard.
+func (m *ConcurrentHashMap) TotalSize() int64 {
+	return m.sizeSum.Load()
+}
+
+// Forgets the size of key in the write locked shard.
+func (m *ConcurrentHashMap) dropSize(shard *ConcurrentMapShared, key string) {
+	if size, ok := shard.sizes[key]; ok {
+		delete(shard.sizes, key)
+		m.sizeSum.Add(-int64(size))
+	}
+}
+
+// Returned when two maps need the same number of shards but don't have it.
+var ErrShardsMismatch = errors.New("cmap: maps have a different number of shards")
+
+// Returned when two maps need to place keys alike but use different hashers,
+// see ShardsCompatible.
+var ErrHasherMismatch = errors.New("cmap: maps use different hashers")
+
+// Reports whether m and other place every key in the shard with the same
+// index, i.e. they have the same number of shards and the same hasher.
+// Hashers are the same if they are the same func value, e.g. XXHash32 or the
+// hasher of a map and its Clone. Closures are only the same as themselves,
+// as closures of one function literal may capture a different seed and place
+// keys differently.
+func (m *ConcurrentHashMap) ShardsCompatible(other *ConcurrentHashMap) bool {
+	return m.checkCompatible(other) == nil
+}
+
+// Returns why m and other aren't ShardsCompatible, if they aren't.
+func (m *ConcurrentHashMap) checkCompatible(other *ConcurrentHashMap) error {
+	if m == other {
+		return nil
+	}
+	a, b := m.loadTable(), other.loadTable()
+	if len(a.shards) != len(b.shards) {
+		return fmt.Errorf("%w: %d and %d", ErrShardsMismatch, len(a.shards), len(b.shards))
+	}
+	if a.hasherID != b.hasherID {
+		return ErrHasherMismatch
+	}
+	return nil
+}
+
+// Serializes SwapContents calls, so shards of two maps are always locked in the same order.
+var swapMu sync.Mutex
+
+// Exchanges the elements of m and other, while every shard of both maps is
+// locked, so no reader observes a partially swapped map. Holders of either
+// pointer see the swapped elements, e.g. to double-buffer a map behind a stable
+// pointer. Both maps must be ShardsCompatible, otherwise an error wrapping
+// ErrShardsMismatch or ErrHasherMismatch is returned and nothing is swapped.
+func (m *ConcurrentHashMap) SwapContents(other *ConcurrentHashMap) error {
+	if m == other {
+		return nil
+	}
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	other.resizeMu.RLock()
+	defer other.resizeMu.RUnlock()
+
+	if err := m.checkCompatible(other); err != nil {
+		return err
+	}
+	a, b := m.loadTable().shards, other.loadTable().shards
+	for _, shards := range []ConcurrentMap{a, b} {
+		for _, shard := range shards {
+			shard.lock()
+		}
+	}
+	for i := range a {
+		a[i].items, b[i].items = b[i].items, a[i].items
+		a[i].stale, b[i].stale = true, true
+		a[i].resetPeak()
+		b[i].resetPeak()
+		a[i].versions, b[i].versions = b[i].versions, a[i].versions
+		a[i].sizes, b[i].sizes = b[i].sizes, a[i].sizes
+		// Access counts follow their keys, unless only one map tracks them.
+		if a[i].hits != nil && b[i].hits != nil {
+			a[i].hits, b[i].hits = b[i].hits, a[i].hits
+		} else if a[i].hits != nil {
+			a[i].hits = make(map[string]*atomic.Int64)
+		} else if b[i].hits != nil {
+			b[i].hits = make(map[string]*atomic.Int64)
+		}
+	}
+	size := m.size.Load()
+	m.size.Store(other.size.Load())
+	other.size.Store(size)
+	sizeSum := m.sizeSum.Load()
+	m.sizeSum.Store(other.sizeSum.Load())
+	other.sizeSum.Store(sizeSum)
+	for _, shards := range []ConcurrentMap{a, b} {
+		for _, shard := range shards {
+			shard.unlock()
+		}
+	}
+	return nil
+}
+
+// Returns a copy of every shard's elements, in shard index order, e.g. to
+// checkpoint the map and later load it back with RestoreShards. The returned
+// maps are copies, not live references, each shard is read locked while it
+// is copied.
+func (m *ConcurrentHashMap) ExportShards() []map[string]interface{} {
+	shards := m.loadTable().shards
+	exported := make([]map[string]interface{}, len(shards))
+	for i, shard := range shards {
+		shard.rlock()
+		items := make(map[string]interface{}, len(shard.items))
+		for key, value := range shard.items {
+			items[key] = value
+		}
+		shard.runlock()
+		exported[i] = items
+	}
+	return exported
+}
+
+// Replaces the elements of every shard with the given maps as a whole,
+// which is much faster than inserting them key by key. shards must come from
+// ExportShards of a map with the same number of shards and hasher, keys are
+// not rehashed. The map takes ownership of the given maps, the caller must not
+// use them afterwards. Every shard stays locked during the swap. Restored
+// elements have no size, see SetWithSize, so TotalSize drops to 0. If the
+// number of maps differs from the number of shards an error wrapping
+// ErrShardsMismatch is returned and nothing is restored.
+func (m *ConcurrentHashMap) RestoreShards(shards []map[string]interface{}) error {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	current := m.loadTable().shards
+	if len(shards) != len(current) {
+		return fmt.Errorf("%w: %d and %d", ErrShardsMismatch, len(current), len(shards))
+	}
+	for _, shard := range current {
+		shard.lock()
+	}
+	size := 0
+	for i, shard := range current {
+		shard.reset()
+		if shards[i] != nil {
+			shard.items = shards[i]
+		}
+		shard.resetPeak()
+		size += len(shard.items)
+	}
+	m.size.Store(int64(size))
+	m.sizeSum.Store(0)
+	for _, shard := range current {
+		shard.unlock()
+	}
+	return nil
+}
+
+// Changes the number of shards of the map, rehashing every element.
+// This is an expensive stop-the-world operation: every shard stays write
+// locked while its elements are moved, and operations on the map block
+// until the new shards are in place. Operations waiting on an old shard
+// are retried on the new ones. Panics if newShards < 1.
+func (m *ConcurrentHashMap) Resize(newShards int) {
+	if newShards <= 0 {
+		panic(ErrInvalidShards)
+	}
+	m.resizeMu.Lock()
+	defer m.resizeMu.Unlock()
+	m.rebuild(newShards, m.loadTable().hasher)
+}
+
+// Changes both the number of shards and the hash function of the map,
+// rehashing every element with hasher, e.g. to move from fnv32 to xxhash
+// after discovering skew. A nil hasher selects fnv32. Like Resize this is an
+// expensive stop-the-world operation. Returns ErrInvalidShards, leaving the
+// map unchanged, if shards < 1.
+func (m *ConcurrentHashMap) Reset(shards int, hasher func(key string) uint32) error {
+	if shards <= 0 {
+		return ErrInvalidShards
+	}
+	m.resizeMu.Lock()
+	defer m.resizeMu.Unlock()
+	m.rebuild(shards, hasher)
+	return nil
+}
+
+// Moves every element to a new table, resizeMu must be write locked.
+func (m *ConcurrentHashMap) rebuild(newShards int, hasher func(key string) uint32) {
+	old := m.loadTable()
+	t := &shardTable{shards: makeShards(newShards, old.opts), hasher: hasher, hasherID: hasherIdentity(hasher), opts: old.opts}
+	for _, shard := range old.shards {
+		shard.lock()
+	}
+	for _, shard := range old.shards {
+		for key, value := range shard.items {
+			t.shards[t.index(key)].items[key] = value
+		}
+		for key, hits := range shard.hits {
+			t.shards[t.index(key)].hits[key] = hits
+		}
+		for key, version := range shard.versions {
+			dst := t.shards[t.index(key)]
+			if dst.versions == nil {
+				dst.versions = make(map[string]uint64)
+			}
+			dst.versions[key] = version
+		}
+		for key, size := range shard.sizes {
+			dst := t.shards[t.index(key)]
+			if dst.sizes == nil {
+				dst.sizes = make(map[string]int)
+			}
+			dst.sizes[key] = size
+		}
+		shard.retired = true
+	}
+	for _, shard := range t.shards {
+		// Shards were sized for the capacity hint, keep it if it is larger.
+		shard.trackPeak()
+		shard.publish()
+	}
+	m.table.Store(t)
+	m.Shards, m.HashMap = newShards, t.shards
+	for _, shard := range old.shards {
+		shard.unlock()
+	}
+}
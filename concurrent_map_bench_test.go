@@ -2,12 +2,11 @@ package cmap
 
 import (
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 )
 
-var SHARDS_COUNT = 32
-
 func BenchmarkItems(b *testing.B) {
 	m := New(SHARDS_COUNT)
 
@@ -20,6 +19,18 @@ func BenchmarkItems(b *testing.B) {
 	}
 }
 
+func BenchmarkToMap(b *testing.B) {
+	m := New(SHARDS_COUNT)
+
+	// Insert 100 elements.
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	for i := 0; i < b.N; i++ {
+		m.ToMap()
+	}
+}
+
 func BenchmarkMarshalJson(b *testing.B) {
 	m := New(SHARDS_COUNT)
 
@@ -167,6 +178,116 @@ func BenchmarkMultiGetSetBlock_256_Shard(b *testing.B) {
 	runWithShards(benchmarkMultiGetSetBlock, b, 256)
 }
 
+func benchmarkWriteDominated(b *testing.B, opts Options) {
+	m := NewWithOptions(opts)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := strconv.Itoa(i % 1000)
+			// One read for every four writes.
+			if i%5 == 0 {
+				m.Get(key)
+			} else {
+				m.Set(key, i)
+			}
+			i++
+		}
+	})
+}
+
+func benchmarkReadMostly(b *testing.B, opts Options) {
+	m := NewWithOptions(opts)
+	// Keys are built up front, so the loop measures the map rather than strconv.
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		m.Set(keys[i], i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%1000]
+			// One write for every nine reads.
+			if i%10 == 0 {
+				m.Set(key, i)
+			} else {
+				m.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkReadMostly_RWMutex(b *testing.B) {
+	benchmarkReadMostly(b, Options{Shards: 256})
+}
+func BenchmarkReadMostly_ReadOptimized(b *testing.B) {
+	benchmarkReadMostly(b, Options{Shards: 256, ReadOptimized: true})
+}
+
+func BenchmarkWriteDominated_RWMutex(b *testing.B) {
+	benchmarkWriteDominated(b, Options{Shards: 32})
+}
+func BenchmarkWriteDominated_Mutex(b *testing.B) {
+	benchmarkWriteDominated(b, Options{Shards: 32, WriteHeavy: true})
+}
+
+func BenchmarkCounterIncrementInt(b *testing.B) {
+	m := New(SHARDS_COUNT)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.IncrementInt("counter", 1)
+	}
+}
+
+func BenchmarkCounterIntMap(b *testing.B) {
+	m := NewIntMap(SHARDS_COUNT)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Add("counter", 1)
+	}
+}
+
+func benchmarkGetLongKey(b *testing.B, shards int) {
+	m := New(shards)
+	// Long keys make the cost of hashing visible.
+	key := strings.Repeat("k", 64)
+	m.Set(key, "value")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Get(key)
+	}
+}
+
+// A single shard skips hashing, compare with the 2 shards case.
+func BenchmarkGetLongKey_1_Shard(b *testing.B) {
+	benchmarkGetLongKey(b, 1)
+}
+func BenchmarkGetLongKey_2_Shard(b *testing.B) {
+	benchmarkGetLongKey(b, 2)
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := New(SHARDS_COUNT)
+		for j := 0; j < 100000; j++ {
+			m.Set(strconv.Itoa(j), j)
+		}
+	}
+}
+
+func BenchmarkBulkLoadWithCapacity(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := NewWithCapacity(SHARDS_COUNT, 100000)
+		for j := 0; j < 100000; j++ {
+			m.Set(strconv.Itoa(j), j)
+		}
+	}
+}
+
 func GetSet(m *ConcurrentHashMap, finished chan struct{}) (set func(key, value string), get func(key, value string)) {
 	return func(key, value string) {
 			for i := 0; i < 10; i++ {
@@ -233,3 +354,65 @@ func BenchmarkConcurrentMapIterConcurrentCb(b *testing.B) {
 		})
 	}
 }
+
+// Predicate costly enough for the parallel version to pay off.
+func expensivePred(key string, val interface{}) bool {
+	h := fnv32(key)
+	for i := 0; i < 100; i++ {
+		h = fnv32(strconv.Itoa(int(h)))
+	}
+	return h%2 == 0
+}
+
+func BenchmarkCountWhere(b *testing.B) {
+	m := New(SHARDS_COUNT)
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), true)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.CountWhere(expensivePred)
+	}
+}
+
+func BenchmarkCountWhereConcurrent(b *testing.B) {
+	m := New(SHARDS_COUNT)
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), true)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.CountWhereConcurrent(expensivePred)
+	}
+}
+
+func BenchmarkMGet(b *testing.B) {
+	m := New(SHARDS_COUNT)
+	keys := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), "value")
+		keys = append(keys, strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MGet(keys)
+	}
+}
+
+func BenchmarkGetLoop(b *testing.B) {
+	m := New(SHARDS_COUNT)
+	keys := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), "value")
+		keys = append(keys, strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmp := make(map[string]interface{}, len(keys))
+		for _, key := range keys {
+			if val, ok := m.Get(key); ok {
+				tmp[key] = val
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package cmap
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Element of a BoundedHashMap shard's recency list.
+type boundedEntry struct {
+	key   string
+	value interface{}
+}
+
+// A shard of BoundedHashMap, every access reorders the recency list,
+// so even reads take the write lock.
+type boundedShard struct {
+	items      map[string]*list.Element
+	order      *list.List // Most recently used entry first.
+	sync.Mutex            // Guards access to items and order.
+}
+
+// A "thread" safe string to anything map holding a bounded number of entries.
+// Every shard evicts its least recently used entry once it is full, which
+// keeps eviction local to a shard at the cost of an approximate global LRU.
+type BoundedHashMap struct {
+	shards    []*boundedShard
+	capacity  int // Maximum number of entries per shard.
+	evictions atomic.Int64
+}
+
+// Creates a new concurrent map holding about maxEntries entries, split evenly
+// between shards, every shard holds at least one entry. Panics if shards < 1.
+func NewBounded(shards, maxEntries int) *BoundedHashMap {
+	if shards <= 0 {
+		panic(ErrInvalidShards)
+	}
+	capacity := maxEntries / shards
+	if capacity < 1 {
+		capacity = 1
+	}
+	m := &BoundedHashMap{shards: make([]*boundedShard, shards), capacity: capacity}
+	for i := range m.shards {
+		m.shards[i] = &boundedShard{items: make(map[string]*list.Element), order: list.New()}
+	}
+	return m
+}
+
+// Returns shard under given key
+func (m *BoundedHashMap) getShard(key string) *boundedShard {
+	return m.shards[shardOf(fnv32(key), len(m.shards))]
+}
+
+// Sets the given value under the specified key, evicting the least recently
+// used entry of its shard if the shard is full.
+func (m *BoundedHashMap) Set(key string, value interface{}) {
+	shard := m.getShard(key)
+	shard.Lock()
+	if elem, ok := shard.items[key]; ok {
+		elem.Value.(*boundedEntry).value = value
+		shard.order.MoveToFront(elem)
+		shard.Unlock()
+		return
+	}
+	if shard.order.Len() >= m.capacity {
+		oldest := shard.order.Back()
+		shard.order.Remove(oldest)
+		delete(shard.items, oldest.Value.(*boundedEntry).key)
+		m.evictions.Add(1)
+	}
+	shard.items[key] = shard.order.PushFront(&boundedEntry{key, value})
+	shard.Unlock()
+}
+
+// Retrieves an element from map under given key, marking it as recently used.
+func (m *BoundedHashMap) Get(key string) (interface{}, bool) {
+	shard := m.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	elem, ok := shard.items[key]
+	if !ok {
+		return nil, false
+	}
+	shard.order.MoveToFront(elem)
+	return elem.Value.(*boundedEntry).value, true
+}
+
+// Looks up an item under specified key, without changing its recency.
+func (m *BoundedHashMap) Has(key string) bool {
+	shard := m.getShard(key)
+	shard.Lock()
+	_, ok := shard.items[key]
+	shard.Unlock()
+	return ok
+}
+
+// Removes an element from the map and returns it
+func (m *BoundedHashMap) Pop(key string) (interface{}, bool) {
+	shard := m.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	elem, ok := shard.items[key]
+	if !ok {
+		return nil, false
+	}
+	shard.order.Remove(elem)
+	delete(shard.items, key)
+	return elem.Value.(*boundedEntry).value, true
+}
+
+// Removes an element from the map.
+func (m *BoundedHashMap) Remove(key string) {
+	m.Pop(key)
+}
+
+// Returns the number of elements within the map.
+func (m *BoundedHashMap) Count() int {
+	count := 0
+	for _, shard := range m.shards {
+		shard.Lock()
+		count += len(shard.items)
+		shard.Unlock()
+	}
+	return count
+}
+
+// Return all keys as []string
+func (m *BoundedHashMap) Keys() []string {
+	keys := make([]string, 0)
+	for _, shard := range m.shards {
+		shard.Lock()
+		for key := range shard.items {
+			keys = append(keys, key)
+		}
+		shard.Unlock()
+	}
+	return keys
+}
+
+// Returns the number of entries evicted so far to make room for new ones.
+func (m *BoundedHashMap) Evictions() int64 {
+	return m.evictions.Load()
+}
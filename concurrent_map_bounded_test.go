@@ -0,0 +1,79 @@
+package cmap
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestBoundedEviction(t *testing.T) {
+	m := NewBounded(1, 3)
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("c", 3)
+
+	// Reading a makes b the least recently used entry.
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Error("a should be present.")
+	}
+	m.Set("d", 4)
+
+	if m.Has("b") {
+		t.Error("b should have been evicted.")
+	}
+	if !m.Has("a") || !m.Has("c") || !m.Has("d") || m.Count() != 3 {
+		t.Error("Expecting a, c and d to remain.")
+	}
+	if m.Evictions() != 1 {
+		t.Error("Expecting one eviction, got", m.Evictions())
+	}
+
+	// Updates don't evict.
+	m.Set("c", 30)
+	if v, _ := m.Get("c"); v != 30 || m.Evictions() != 1 {
+		t.Error("updating an existing key shouldn't evict.")
+	}
+}
+
+func TestBoundedRemoveAndPop(t *testing.T) {
+	m := NewBounded(4, 8)
+	m.Set("a", 1)
+	m.Set("b", 2)
+
+	if v, ok := m.Pop("a"); !ok || v != 1 {
+		t.Error("Pop didn't return the stored value.")
+	}
+	m.Remove("b")
+	if m.Count() != 0 || len(m.Keys()) != 0 {
+		t.Error("map should be empty.")
+	}
+	if _, ok := m.Pop("a"); ok {
+		t.Error("Pop shouldn't find removed keys.")
+	}
+}
+
+func TestBoundedConcurrent(t *testing.T) {
+	const shards, maxEntries = 4, 40
+	m := NewBounded(shards, maxEntries)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := strconv.Itoa(g*500 + i)
+				m.Set(key, i)
+				m.Get(key)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if m.Count() > maxEntries {
+		t.Error("map grew beyond its bound", m.Count())
+	}
+	if int(m.Evictions()) != 2000-m.Count() {
+		t.Error("every missing entry should have been evicted.")
+	}
+}
@@ -0,0 +1,216 @@
+package cmap
+
+import (
+	"sync"
+	"time"
+)
+
+// Value stored by ExpiringHashMap along with its deadline.
+type expiringItem struct {
+	value   interface{}
+	expires int64 // UnixNano deadline, 0 means the item never expires.
+}
+
+func (i expiringItem) expired(now int64) bool {
+	return i.expires > 0 && now > i.expires
+}
+
+// A "thread" safe string to anything map whose entries may expire.
+// Expired entries are invisible to readers right away and are deleted
+// either lazily by Get or by the janitor goroutine.
+type ExpiringHashMap struct {
+	items *ConcurrentHashMapG[expiringItem]
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// Creates a new concurrent map supporting per entry TTLs.
+// A janitor goroutine deletes expired entries every cleanupInterval,
+// no janitor is started if cleanupInterval <= 0.
+// The janitor keeps the map alive, call Stop once the map is no longer used.
+// Panics if shards < 1.
+func NewWithExpiration(shards int, cleanupInterval time.Duration) *ExpiringHashMap {
+	m := &ExpiringHashMap{items: NewG[expiringItem](shards), stop: make(chan struct{})}
+	if cleanupInterval > 0 {
+		go m.janitor(cleanupInterval)
+	}
+	return m
+}
+
+func (m *ExpiringHashMap) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.DeleteExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Terminates the janitor goroutine, it is safe to call Stop more than once.
+func (m *ExpiringHashMap) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Sets the given value under the specified key, the entry never expires.
+func (m *ExpiringHashMap) Set(key string, value interface{}) {
+	m.items.Set(key, expiringItem{value: value})
+}
+
+// Sets the given value under the specified key, the entry expires after ttl.
+func (m *ExpiringHashMap) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	m.items.Set(key, expiringItem{value: value, expires: time.Now().Add(ttl).UnixNano()})
+}
+
+// Retrieves an element from map under given key.
+// Expired entries are reported as missing and deleted on the way.
+func (m *ExpiringHashMap) Get(key string) (interface{}, bool) {
+	// Get shard
+	shard := m.items.GetShard(key)
+	shard.RLock()
+	// Get item from shard.
+	item, ok := shard.items[key]
+	shard.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if now := time.Now().UnixNano(); item.expired(now) {
+		// Item may have been replaced since RUnlock, check again before deleting.
+		shard.Lock()
+		if item, ok := shard.items[key]; ok && item.expired(now) {
+			delete(shard.items, key)
+		}
+		shard.Unlock()
+		return nil, false
+	}
+	return item.value, true
+}
+
+// Resets the expiry of the entry under key to ttl from now, e.g. to keep an
+// active session alive. Returns false if the key is missing or expired.
+func (m *ExpiringHashMap) Touch(key string, ttl time.Duration) bool {
+	_, ok := m.GetResetTTL(key, ttl)
+	return ok
+}
+
+// Retrieves an element from map under given key and resets its expiry to ttl
+// from now, atomically. Expired entries are reported as missing and deleted.
+func (m *ExpiringHashMap) GetResetTTL(key string, ttl time.Duration) (interface{}, bool) {
+	// Get shard
+	shard := m.items.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	item, ok := shard.items[key]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if item.expired(now.UnixNano()) {
+		delete(shard.items, key)
+		return nil, false
+	}
+	item.expires = now.Add(ttl).UnixNano()
+	shard.items[key] = item
+	return item.value, true
+}
+
+// Retrieves an element from map under given key, if it is missing or expired
+// fn computes it and the result is stored with the given ttl. The shard stays
+// locked while fn runs, so concurrent callers missing the same key wait for
+// the first one and get its value instead of computing it again.
+// If fn returns an error nothing is stored and the error is returned.
+// fn MUST NOT try to access other keys in same map, as it can lead to deadlock.
+func (m *ExpiringHashMap) GetOrComputeTTL(key string, ttl time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	// Get shard
+	shard := m.items.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if item, ok := shard.items[key]; ok && !item.expired(time.Now().UnixNano()) {
+		return item.value, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	shard.items[key] = expiringItem{value: value, expires: time.Now().Add(ttl).UnixNano()}
+	return value, nil
+}
+
+// Looks up an item under specified key
+func (m *ExpiringHashMap) Has(key string) bool {
+	_, ok := m.Get(key)
+	return ok
+}
+
+// Removes an element from the map.
+func (m *ExpiringHashMap) Remove(key string) {
+	m.items.Remove(key)
+}
+
+// Removes an element from the map and returns it
+func (m *ExpiringHashMap) Pop(key string) (interface{}, bool) {
+	item, ok := m.items.Pop(key)
+	if !ok || item.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+	return item.value, true
+}
+
+// Returns the number of elements within the map, expired entries are not counted.
+func (m *ExpiringHashMap) Count() int {
+	now := time.Now().UnixNano()
+	count := 0
+	for _, shard := range m.items.HashMap {
+		shard.RLock()
+		for _, item := range shard.items {
+			if !item.expired(now) {
+				count++
+			}
+		}
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Return all keys of entries which did not expire yet.
+func (m *ExpiringHashMap) Keys() []string {
+	now := time.Now().UnixNano()
+	keys := make([]string, 0)
+	m.items.IterCb(func(key string, item expiringItem) {
+		if !item.expired(now) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// Returns all entries which did not expire yet as map[string]interface{}
+func (m *ExpiringHashMap) Items() map[string]interface{} {
+	now := time.Now().UnixNano()
+	tmp := make(map[string]interface{})
+	m.items.IterCb(func(key string, item expiringItem) {
+		if !item.expired(now) {
+			tmp[key] = item.value
+		}
+	})
+	return tmp
+}
+
+// Deletes every expired entry, this is what the janitor runs periodically.
+func (m *ExpiringHashMap) DeleteExpired() {
+	for _, shard := range m.items.HashMap {
+		now := time.Now().UnixNano()
+		shard.Lock()
+		for key, item := range shard.items {
+			if item.expired(now) {
+				delete(shard.items, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
@@ -0,0 +1,181 @@
+package cmap
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiringGet(t *testing.T) {
+	m := NewWithExpiration(64, 0)
+	defer m.Stop()
+
+	m.Set("forever", Animal{"elephant"})
+	m.SetWithTTL("long", Animal{"tortoise"}, time.Hour)
+
+	if m.Count() != 2 {
+		t.Error("map should contain exactly two elements.")
+	}
+
+	m.SetWithTTL("short", Animal{"mayfly"}, time.Millisecond)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if v, ok := m.Get("short"); ok || v != nil {
+		t.Error("expired item should be reported as missing.")
+	}
+
+	if _, ok := m.Get("long"); !ok {
+		t.Error("item shouldn't have expired yet.")
+	}
+
+	if _, ok := m.Get("forever"); !ok {
+		t.Error("item without ttl shouldn't expire.")
+	}
+
+	if m.Count() != 2 {
+		t.Error("expired items shouldn't be counted.")
+	}
+
+	if m.items.Count() != 2 {
+		t.Error("Get should have deleted the expired item.")
+	}
+}
+
+func TestExpiringCountSkipsUnreaped(t *testing.T) {
+	m := NewWithExpiration(64, 0)
+	defer m.Stop()
+
+	m.SetWithTTL("a", 1, time.Millisecond)
+	m.SetWithTTL("b", 2, time.Millisecond)
+	m.Set("c", 3)
+	time.Sleep(5 * time.Millisecond)
+
+	if m.Count() != 1 || len(m.Keys()) != 1 || len(m.Items()) != 1 {
+		t.Error("expired items shouldn't be visible.")
+	}
+
+	m.DeleteExpired()
+	if m.items.Count() != 1 {
+		t.Error("DeleteExpired should have removed expired items.")
+	}
+}
+
+func TestExpiringJanitor(t *testing.T) {
+	m := NewWithExpiration(64, time.Millisecond)
+	defer m.Stop()
+
+	for _, key := range []string{"a", "b", "c"} {
+		m.SetWithTTL(key, key, time.Millisecond)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for m.items.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("janitor didn't delete expired items.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	m.Stop()
+	m.Stop()
+}
+
+func TestExpiringTouch(t *testing.T) {
+	m := NewWithExpiration(64, 0)
+	defer m.Stop()
+
+	// TTLs are only ever shortened, so no assertion depends on how fast the test runs.
+	m.SetWithTTL("session", Animal{"dog"}, time.Hour)
+	m.SetWithTTL("kept", Animal{"cat"}, time.Hour)
+	m.Set("forever", Animal{"elephant"})
+
+	if !m.Touch("session", time.Millisecond) {
+		t.Error("Touch should refresh an existing item.")
+	}
+	if v, ok := m.GetResetTTL("forever", time.Millisecond); !ok || v != (Animal{"elephant"}) {
+		t.Error("GetResetTTL didn't return the stored value.")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if m.Has("session") {
+		t.Error("Touch should have replaced the ttl of the item.")
+	}
+	if m.Has("forever") {
+		t.Error("GetResetTTL should have given the item a ttl.")
+	}
+	if !m.Has("kept") {
+		t.Error("items which weren't touched should keep their ttl.")
+	}
+	if m.Touch("forever", time.Hour) || m.Touch("missing", time.Hour) {
+		t.Error("Touch shouldn't revive expired or missing items.")
+	}
+}
+
+func TestExpiringGetOrComputeTTL(t *testing.T) {
+	m := NewWithExpiration(64, 0)
+	defer m.Stop()
+
+	var calls atomic.Int32
+	compute := func() (interface{}, error) {
+		calls.Add(1)
+		time.Sleep(time.Millisecond)
+		return Animal{"elephant"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := m.GetOrComputeTTL("elephant", time.Hour, compute); err != nil || v != (Animal{"elephant"}) {
+				t.Error("GetOrComputeTTL didn't return the computed value.", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Error("value should have been computed once, got", calls.Load())
+	}
+
+	errBoom := errors.New("boom")
+	if _, err := m.GetOrComputeTTL("monkey", time.Hour, func() (interface{}, error) { return nil, errBoom }); err != errBoom {
+		t.Error("GetOrComputeTTL should return the error of fn, got", err)
+	}
+	if m.Has("monkey") {
+		t.Error("nothing should be stored when fn fails.")
+	}
+
+	m.SetWithTTL("dog", Animal{"old dog"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	v, _ := m.GetOrComputeTTL("dog", time.Hour, func() (interface{}, error) { return Animal{"dog"}, nil })
+	if v != (Animal{"dog"}) {
+		t.Error("expired items should be computed again, got", v)
+	}
+}
+
+func TestExpiringRemoveAndPop(t *testing.T) {
+	m := NewWithExpiration(64, 0)
+	defer m.Stop()
+
+	m.Set("a", 1)
+	m.SetWithTTL("b", 2, time.Millisecond)
+
+	if v, ok := m.Pop("a"); !ok || v != 1 {
+		t.Error("Pop didn't return the stored value.")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := m.Pop("b"); ok {
+		t.Error("Pop shouldn't return expired items.")
+	}
+
+	m.Set("c", 3)
+	m.Remove("c")
+	if m.Has("c") {
+		t.Error("c should have been removed.")
+	}
+}
@@ -0,0 +1,230 @@
+package cmap
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Typed variant of ConcurrentHashMap, values are stored as V instead of interface{}.
+// Sharding is identical to ConcurrentHashMap (fnv32 of the key modulo Shards).
+type ConcurrentHashMapG[V any] struct {
+	Shards  int
+	HashMap ConcurrentMapG[V]
+}
+
+// A "thread" safe map of type string:V.
+// To avoid lock bottlenecks this map is dived to several (Shards) map shards.
+type ConcurrentMapG[V any] []*ConcurrentMapSharedG[V]
+
+// A "thread" safe string to V map.
+type ConcurrentMapSharedG[V any] struct {
+	items        map[string]V
+	sync.RWMutex // Read Write mutex, guards access to internal map.
+}
+
+// Creates a new typed concurrent map, panics if shards < 1.
+func NewG[V any](shards int) *ConcurrentHashMapG[V] {
+	if shards <= 0 {
+		panic(ErrInvalidShards)
+	}
+	m := &ConcurrentHashMapG[V]{Shards: shards, HashMap: make(ConcurrentMapG[V], shards)}
+	for i := 0; i < shards; i++ {
+		m.HashMap[i] = &ConcurrentMapSharedG[V]{items: make(map[string]V)}
+	}
+	return m
+}
+
+// Returns shard under given key
+func (m *ConcurrentHashMapG[V]) GetShard(key string) *ConcurrentMapSharedG[V] {
+	return m.HashMap[shardOf(fnv32(key), m.Shards)]
+}
+
+// Sets the given map
+func (m *ConcurrentHashMapG[V]) MSet(data map[string]V) {
+	for key, value := range data {
+		shard := m.GetShard(key)
+		shard.Lock()
+		shard.items[key] = value
+		shard.Unlock()
+	}
+}
+
+// Sets the given value under the specified key.
+func (m *ConcurrentHashMapG[V]) Set(key string, value V) {
+	// Get map shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	shard.items[key] = value
+	shard.Unlock()
+}
+
+// Typed counterpart of UpsertCb, the same locking caveats apply.
+type UpsertCbG[V any] func(exist bool, valueInMap V, newValue V) V
+
+// Insert or Update - updates existing element or inserts a new one using UpsertCbG
+func (m *ConcurrentHashMapG[V]) Upsert(key string, value V, cb UpsertCbG[V]) (res V) {
+	shard := m.GetShard(key)
+	shard.Lock()
+	v, ok := shard.items[key]
+	res = cb(ok, v, value)
+	shard.items[key] = res
+	shard.Unlock()
+	return res
+}
+
+// Sets the given value under the specified key if no value was associated with it.
+func (m *ConcurrentHashMapG[V]) SetIfAbsent(key string, value V) bool {
+	// Get map shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	_, ok := shard.items[key]
+	if !ok {
+		shard.items[key] = value
+	}
+	shard.Unlock()
+	return !ok
+}
+
+// Retrieves an element from map under given key.
+// The zero value of V is returned when the key is missing.
+func (m *ConcurrentHashMapG[V]) Get(key string) (V, bool) {
+	// Get shard
+	shard := m.GetShard(key)
+	shard.RLock()
+	// Get item from shard.
+	val, ok := shard.items[key]
+	shard.RUnlock()
+	return val, ok
+}
+
+// Returns the number of elements within the map.
+func (m *ConcurrentHashMapG[V]) Count() int {
+	count := 0
+	for i := 0; i < m.Shards; i++ {
+		shard := m.HashMap[i]
+		shard.RLock()
+		count += len(shard.items)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Looks up an item under specified key
+func (m *ConcurrentHashMapG[V]) Has(key string) bool {
+	// Get shard
+	shard := m.GetShard(key)
+	shard.RLock()
+	// See if element is within shard.
+	_, ok := shard.items[key]
+	shard.RUnlock()
+	return ok
+}
+
+// Removes an element from the map.
+func (m *ConcurrentHashMapG[V]) Remove(key string) {
+	// Try to get shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	delete(shard.items, key)
+	shard.Unlock()
+}
+
+// Removes an element from the map and returns it
+func (m *ConcurrentHashMapG[V]) Pop(key string) (v V, exists bool) {
+	// Try to get shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	v, exists = shard.items[key]
+	delete(shard.items, key)
+	shard.Unlock()
+	return v, exists
+}
+
+// Checks if map is empty.
+func (m *ConcurrentHashMapG[V]) IsEmpty() bool {
+	return m.Count() == 0
+}
+
+// Typed counterpart of IterCb.
+type IterCbG[V any] func(key string, v V)
+
+// Callback based iterator, cheapest way to read
+// all elements in a map.
+func (m *ConcurrentHashMapG[V]) IterCb(fn IterCbG[V]) {
+	for idx := range m.HashMap {
+		shard := m.HashMap[idx]
+		shard.RLock()
+		for key, value := range shard.items {
+			fn(key, value)
+		}
+		shard.RUnlock()
+	}
+}
+
+// Returns all items as map[string]V
+func (m *ConcurrentHashMapG[V]) Items() map[string]V {
+	tmp := make(map[string]V, m.Count())
+
+	// Insert items to temporary map.
+	m.IterCb(func(key string, v V) {
+		tmp[key] = v
+	})
+
+	return tmp
+}
+
+// Return all keys as []string
+func (m *ConcurrentHashMapG[V]) Keys() []string {
+	keys := make([]string, 0, m.Count())
+	m.IterCb(func(key string, v V) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// Reviles ConcurrentHashMapG "private" variables to json marshal.
+func (m *ConcurrentHashMapG[V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Items())
+}
+
+// Calls mapper for every element of m and combines the results with reducer.
+// Shards are processed concurrently, one goroutine per shard reduces the
+// results of its own shard, the partial results are then combined in shard
+// index order. Elements are visited in an unspecified order, so reducer should
+// be associative and commutative. Returns the zero R for an empty map.
+// Go methods can't have type parameters, hence MapReduce is a function.
+func MapReduce[V, R any](m *ConcurrentHashMapG[V], mapper func(key string, v V) R, reducer func(a, b R) R) R {
+	partials := make([]R, len(m.HashMap))
+	found := make([]bool, len(m.HashMap))
+	var wg sync.WaitGroup
+
+	wg.Add(len(m.HashMap))
+	for i, shard := range m.HashMap {
+		go func(i int, shard *ConcurrentMapSharedG[V]) {
+			defer wg.Done()
+			shard.RLock()
+			defer shard.RUnlock()
+			for key, value := range shard.items {
+				r := mapper(key, value)
+				if found[i] {
+					r = reducer(partials[i], r)
+				}
+				partials[i], found[i] = r, true
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	var res R
+	ok := false
+	for i, partial := range partials {
+		if !found[i] {
+			continue
+		}
+		if ok {
+			partial = reducer(res, partial)
+		}
+		res, ok = partial, true
+	}
+	return res
+}
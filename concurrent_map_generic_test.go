@@ -0,0 +1,138 @@
+package cmap
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestGMapCreation(t *testing.T) {
+	m := NewG[Animal](64)
+	if m == nil {
+		t.Error("map is null.")
+	}
+
+	if m.Count() != 0 {
+		t.Error("new map should be empty.")
+	}
+}
+
+func TestGGet(t *testing.T) {
+	m := NewG[Animal](64)
+
+	// Get a missing element.
+	val, ok := m.Get("Money")
+
+	if ok == true {
+		t.Error("ok should be false when item is missing from map.")
+	}
+
+	if val != (Animal{}) {
+		t.Error("Missing values should return the zero value.")
+	}
+
+	m.Set("elephant", Animal{"elephant"})
+
+	elephant, ok := m.Get("elephant")
+	if !ok || elephant.name != "elephant" {
+		t.Error("item was modified.")
+	}
+}
+
+func TestGRemoveAndPop(t *testing.T) {
+	m := NewG[int](64)
+	m.Set("a", 1)
+	m.Set("b", 2)
+
+	m.Remove("a")
+	if m.Has("a") {
+		t.Error("a should have been removed.")
+	}
+
+	v, ok := m.Pop("b")
+	if !ok || v != 2 {
+		t.Error("Pop didn't return the stored value.")
+	}
+
+	if !m.IsEmpty() {
+		t.Error("map should be empty.")
+	}
+}
+
+func TestGUpsert(t *testing.T) {
+	m := NewG[[]string](64)
+	cb := func(exists bool, valueInMap []string, newValue []string) []string {
+		return append(valueInMap, newValue...)
+	}
+
+	m.Upsert("marine", []string{"dolphin"}, cb)
+	m.Upsert("marine", []string{"whale"}, cb)
+
+	marine, _ := m.Get("marine")
+	if len(marine) != 2 || marine[0] != "dolphin" || marine[1] != "whale" {
+		t.Error("Upsert, then Upsert failed")
+	}
+}
+
+func TestGItemsAndKeys(t *testing.T) {
+	m := NewG[int](64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	if len(m.Keys()) != 100 {
+		t.Error("We should have counted 100 keys.")
+	}
+
+	items := m.Items()
+	if len(items) != 100 || items["42"] != 42 {
+		t.Error("Items should return every stored element.")
+	}
+
+	if m.SetIfAbsent("42", 0) {
+		t.Error("map set a new value even the entry is already present")
+	}
+}
+
+func TestGJsonMarshal(t *testing.T) {
+	expected := "{\"a\":1,\"b\":2}"
+	m := NewG[int](2)
+	m.Set("a", 1)
+	m.Set("b", 2)
+	j, err := json.Marshal(m)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(j) != expected {
+		t.Error("json", string(j), "differ from expected", expected)
+	}
+}
+
+func TestGMapReduce(t *testing.T) {
+	m := NewG[int](64)
+	if sum := MapReduce(m, func(key string, v int) int { return v }, func(a, b int) int { return a + b }); sum != 0 {
+		t.Error("empty map should reduce to zero, got", sum)
+	}
+
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	sum := MapReduce(m, func(key string, v int) int { return v }, func(a, b int) int { return a + b })
+	if sum != 499500 {
+		t.Error("Expecting sum 499500, got", sum)
+	}
+
+	longest := MapReduce(m,
+		func(key string, v int) string { return key },
+		func(a, b string) string {
+			if len(b) > len(a) || (len(b) == len(a) && b > a) {
+				return b
+			}
+			return a
+		})
+	if longest != "999" {
+		t.Error("Expecting longest key 999, got", longest)
+	}
+}
@@ -0,0 +1,49 @@
+package cmap
+
+// A "thread" safe string to int64 map for counters. Values are stored
+// as int64 rather than interface{}, so updating a counter never allocates.
+type ConcurrentIntMap struct {
+	items *ConcurrentHashMapG[int64]
+}
+
+// Creates a new concurrent counter map, panics if shards < 1.
+func NewIntMap(shards int) *ConcurrentIntMap {
+	return &ConcurrentIntMap{items: NewG[int64](shards)}
+}
+
+// Atomically adds delta to the counter under key and returns the new total,
+// a missing key counts as 0.
+func (m *ConcurrentIntMap) Add(key string, delta int64) int64 {
+	// Get map shard.
+	shard := m.items.GetShard(key)
+	shard.Lock()
+	total := shard.items[key] + delta
+	shard.items[key] = total
+	shard.Unlock()
+	return total
+}
+
+// Sets the given value under the specified key.
+func (m *ConcurrentIntMap) Set(key string, value int64) {
+	m.items.Set(key, value)
+}
+
+// Retrieves an element from map under given key.
+func (m *ConcurrentIntMap) Get(key string) (int64, bool) {
+	return m.items.Get(key)
+}
+
+// Removes an element from the map.
+func (m *ConcurrentIntMap) Remove(key string) {
+	m.items.Remove(key)
+}
+
+// Returns the number of elements within the map.
+func (m *ConcurrentIntMap) Count() int {
+	return m.items.Count()
+}
+
+// Returns all items as map[string]int64
+func (m *ConcurrentIntMap) Items() map[string]int64 {
+	return m.items.Items()
+}
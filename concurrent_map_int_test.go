@@ -0,0 +1,53 @@
+package cmap
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIntMap(t *testing.T) {
+	m := NewIntMap(64)
+
+	if total := m.Add("visits", 2); total != 2 {
+		t.Error("missing counter should start at 0, got", total)
+	}
+	if total := m.Add("visits", -1); total != 1 {
+		t.Error("Expecting 1, got", total)
+	}
+
+	m.Set("errors", 10)
+	if v, ok := m.Get("errors"); !ok || v != 10 {
+		t.Error("Get didn't return the stored value.")
+	}
+	if _, ok := m.Get("missing"); ok {
+		t.Error("missing key should be reported as such.")
+	}
+
+	m.Remove("errors")
+	if m.Count() != 1 || m.Items()["visits"] != 1 {
+		t.Error("Expecting only visits to remain.")
+	}
+}
+
+func TestIntMapConcurrentAdd(t *testing.T) {
+	m := NewIntMap(8)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Add(strconv.Itoa(i%10), 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for key, v := range m.Items() {
+		if v != 800 {
+			t.Error("increments were lost for", key, v)
+		}
+	}
+}
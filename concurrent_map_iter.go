@@ -0,0 +1,33 @@
+//go:build go1.23
+
+package cmap
+
+import "iter"
+
+// Returns an iterator over every element for use with range, e.g.
+// for key, value := range m.All(). Each shard is read locked while its
+// elements are yielded, breaking out of the loop unlocks it right away and
+// leaves no goroutine behind, unlike the channel based iterators.
+// The loop body MUST NOT access the map, not even to read it, as it can lead
+// to deadlock since Go sync.RWLock is not reentrant.
+func (m *ConcurrentHashMap) All() iter.Seq2[string, interface{}] {
+	return func(yield func(string, interface{}) bool) {
+		for _, shard := range m.loadTable().shards {
+			if !yieldShard(shard, yield) {
+				return
+			}
+		}
+	}
+}
+
+// Yields the elements of shard under its read lock, returns false once yield did.
+func yieldShard(shard *ConcurrentMapShared, yield func(string, interface{}) bool) bool {
+	shard.rlock()
+	defer shard.runlock()
+	for key, value := range shard.items {
+		if !yield(key, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+//go:build go1.23
+
+package cmap
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	counter := 0
+	for key, value := range m.All() {
+		if value != (Animal{key}) {
+			t.Error("unexpected value for", key)
+		}
+		counter++
+	}
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	counter = 0
+	for range m.All() {
+		counter++
+		if counter == 10 {
+			break
+		}
+	}
+	// Breaking out released the shard, writes don't block.
+	m.Set("new", Animal{"new"})
+	if counter != 10 || m.Count() != 101 {
+		t.Error("break should stop the iteration.")
+	}
+}
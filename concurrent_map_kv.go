@@ -0,0 +1,207 @@
+package cmap
+
+import (
+	"sync"
+)
+
+// Hash function used to pick the shard of a key.
+type Hasher[K comparable] func(key K) uint32
+
+// Integer key types supported by HashInteger.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Hasher for string keys, the same fnv32 ConcurrentHashMap uses.
+func HashString(key string) uint32 {
+	return fnv32(key)
+}
+
+// Hasher for integer keys, fnv32 over the 8 little endian bytes of the key.
+func HashInteger[K Integer](key K) uint32 {
+	k := uint64(key)
+	hash := uint32(2166136261)
+	const prime32 = uint32(16777619)
+	for i := 0; i < 8; i++ {
+		hash *= prime32
+		hash ^= uint32(byte(k >> (8 * i)))
+	}
+	return hash
+}
+
+// Fully generic variant of ConcurrentHashMap, keyed by any comparable K.
+type ConcurrentHashMapKV[K comparable, V any] struct {
+	Shards  int
+	HashMap ConcurrentMapKV[K, V]
+	hasher  Hasher[K]
+}
+
+// A "thread" safe map of type K:V.
+// To avoid lock bottlenecks this map is dived to several (Shards) map shards.
+type ConcurrentMapKV[K comparable, V any] []*ConcurrentMapSharedKV[K, V]
+
+// A "thread" safe K to V map.
+type ConcurrentMapSharedKV[K comparable, V any] struct {
+	items        map[K]V
+	sync.RWMutex // Read Write mutex, guards access to internal map.
+}
+
+// Creates a new concurrent map, hasher picks the shard of every key
+// (see HashString and HashInteger).
+// Panics if shards < 1 or hasher is nil.
+func NewKV[K comparable, V any](shards int, hasher Hasher[K]) *ConcurrentHashMapKV[K, V] {
+	if shards <= 0 {
+		panic(ErrInvalidShards)
+	}
+	if hasher == nil {
+		panic("cmap: NewKV needs a non nil hasher")
+	}
+	m := &ConcurrentHashMapKV[K, V]{Shards: shards, HashMap: make(ConcurrentMapKV[K, V], shards), hasher: hasher}
+	for i := 0; i < shards; i++ {
+		m.HashMap[i] = &ConcurrentMapSharedKV[K, V]{items: make(map[K]V)}
+	}
+	return m
+}
+
+// Returns shard under given key
+func (m *ConcurrentHashMapKV[K, V]) GetShard(key K) *ConcurrentMapSharedKV[K, V] {
+	return m.HashMap[shardOf(m.hasher(key), m.Shards)]
+}
+
+// Sets the given map
+func (m *ConcurrentHashMapKV[K, V]) MSet(data map[K]V) {
+	for key, value := range data {
+		shard := m.GetShard(key)
+		shard.Lock()
+		shard.items[key] = value
+		shard.Unlock()
+	}
+}
+
+// Sets the given value under the specified key.
+func (m *ConcurrentHashMapKV[K, V]) Set(key K, value V) {
+	// Get map shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	shard.items[key] = value
+	shard.Unlock()
+}
+
+// Insert or Update - updates existing element or inserts a new one using UpsertCbG
+func (m *ConcurrentHashMapKV[K, V]) Upsert(key K, value V, cb UpsertCbG[V]) (res V) {
+	shard := m.GetShard(key)
+	shard.Lock()
+	v, ok := shard.items[key]
+	res = cb(ok, v, value)
+	shard.items[key] = res
+	shard.Unlock()
+	return res
+}
+
+// Sets the given value under the specified key if no value was associated with it.
+func (m *ConcurrentHashMapKV[K, V]) SetIfAbsent(key K, value V) bool {
+	// Get map shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	_, ok := shard.items[key]
+	if !ok {
+		shard.items[key] = value
+	}
+	shard.Unlock()
+	return !ok
+}
+
+// Retrieves an element from map under given key.
+// The zero value of V is returned when the key is missing.
+func (m *ConcurrentHashMapKV[K, V]) Get(key K) (V, bool) {
+	// Get shard
+	shard := m.GetShard(key)
+	shard.RLock()
+	// Get item from shard.
+	val, ok := shard.items[key]
+	shard.RUnlock()
+	return val, ok
+}
+
+// Returns the number of elements within the map.
+func (m *ConcurrentHashMapKV[K, V]) Count() int {
+	count := 0
+	for i := 0; i < m.Shards; i++ {
+		shard := m.HashMap[i]
+		shard.RLock()
+		count += len(shard.items)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Looks up an item under specified key
+func (m *ConcurrentHashMapKV[K, V]) Has(key K) bool {
+	// Get shard
+	shard := m.GetShard(key)
+	shard.RLock()
+	// See if element is within shard.
+	_, ok := shard.items[key]
+	shard.RUnlock()
+	return ok
+}
+
+// Removes an element from the map.
+func (m *ConcurrentHashMapKV[K, V]) Remove(key K) {
+	// Try to get shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	delete(shard.items, key)
+	shard.Unlock()
+}
+
+// Removes an element from the map and returns it
+func (m *ConcurrentHashMapKV[K, V]) Pop(key K) (v V, exists bool) {
+	// Try to get shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	v, exists = shard.items[key]
+	delete(shard.items, key)
+	shard.Unlock()
+	return v, exists
+}
+
+// Checks if map is empty.
+func (m *ConcurrentHashMapKV[K, V]) IsEmpty() bool {
+	return m.Count() == 0
+}
+
+// Callback based iterator, cheapest way to read
+// all elements in a map.
+func (m *ConcurrentHashMapKV[K, V]) IterCb(fn func(key K, v V)) {
+	for idx := range m.HashMap {
+		shard := m.HashMap[idx]
+		shard.RLock()
+		for key, value := range shard.items {
+			fn(key, value)
+		}
+		shard.RUnlock()
+	}
+}
+
+// Returns all items as map[K]V
+func (m *ConcurrentHashMapKV[K, V]) Items() map[K]V {
+	tmp := make(map[K]V, m.Count())
+
+	// Insert items to temporary map.
+	m.IterCb(func(key K, v V) {
+		tmp[key] = v
+	})
+
+	return tmp
+}
+
+// Return all keys as []K
+func (m *ConcurrentHashMapKV[K, V]) Keys() []K {
+	keys := make([]K, 0, m.Count())
+	m.IterCb(func(key K, v V) {
+		keys = append(keys, key)
+	})
+	return keys
+}
@@ -0,0 +1,99 @@
+package cmap
+
+import (
+	"strconv"
+	"testing"
+)
+
+type point struct {
+	x, y int
+}
+
+func TestKVIntegerKeys(t *testing.T) {
+	m := NewKV[int64, Animal](64, HashInteger[int64])
+	for i := int64(0); i < 100; i++ {
+		m.Set(i, Animal{strconv.FormatInt(i, 10)})
+	}
+
+	if m.Count() != 100 {
+		t.Error("Expecting 100 element within map.")
+	}
+
+	monkey, ok := m.Get(42)
+	if !ok || monkey.name != "42" {
+		t.Error("item was modified.")
+	}
+
+	if len(m.Keys()) != 100 {
+		t.Error("We should have counted 100 keys.")
+	}
+
+	m.Remove(42)
+	if m.Has(42) {
+		t.Error("42 should have been removed.")
+	}
+
+	v, ok := m.Pop(7)
+	if !ok || v.name != "7" {
+		t.Error("Pop didn't return the stored value.")
+	}
+
+	if m.Count() != 98 {
+		t.Error("Expecting 98 element within map.")
+	}
+}
+
+func TestKVStructKeys(t *testing.T) {
+	hasher := func(p point) uint32 {
+		return HashInteger(p.x)*31 + HashInteger(p.y)
+	}
+	m := NewKV[point, int](16, hasher)
+
+	cb := func(exists bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	}
+	m.Upsert(point{1, 2}, 1, cb)
+	m.Upsert(point{1, 2}, 1, cb)
+	m.Upsert(point{2, 1}, 1, cb)
+
+	if v, _ := m.Get(point{1, 2}); v != 2 {
+		t.Error("Upsert, then Upsert failed")
+	}
+
+	if v, _ := m.Get(point{2, 1}); v != 1 {
+		t.Error("Upsert failed")
+	}
+}
+
+func TestKVStringHasher(t *testing.T) {
+	m := NewKV[string, int](64, HashString)
+	m.Set("a", 1)
+
+	if HashString("a") != fnv32("a") {
+		t.Error("HashString should match the default sharding hash.")
+	}
+
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Error("item was modified.")
+	}
+}
+
+func TestHashIntegerSpread(t *testing.T) {
+	shards := make(map[uint32]bool)
+	for i := 0; i < 1000; i++ {
+		shards[HashInteger(i)%16] = true
+	}
+
+	if len(shards) != 16 {
+		t.Error("HashInteger should spread sequential keys across every shard.")
+	}
+}
+
+func TestKVNilHasher(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewKV should panic without a hasher.")
+		}
+	}()
+	NewKV[string, int](4, nil)
+}
@@ -0,0 +1,44 @@
+package cmap
+
+// A read only view of a ConcurrentHashMap, e.g. for code which must not
+// modify the map. Reads go to the underlying map, so the view reflects
+// updates made by the map's owner.
+type ReadOnlyMap struct {
+	m *ConcurrentHashMap
+}
+
+// Returns a read only view of the map.
+func (m *ConcurrentHashMap) ReadOnlyView() ReadOnlyMap {
+	return ReadOnlyMap{m}
+}
+
+// Retrieves an element from map under given key.
+func (v ReadOnlyMap) Get(key string) (interface{}, bool) {
+	return v.m.Get(key)
+}
+
+// Looks up an item under specified key
+func (v ReadOnlyMap) Has(key string) bool {
+	return v.m.Has(key)
+}
+
+// Returns the number of elements within the map.
+func (v ReadOnlyMap) Count() int {
+	return v.m.Count()
+}
+
+// Return all keys as []string
+func (v ReadOnlyMap) Keys() []string {
+	return v.m.Keys()
+}
+
+// Returns a buffered iterator which could be used in a for range loop.
+func (v ReadOnlyMap) Iter() <-chan Tuple {
+	return v.m.IterBuffered()
+}
+
+// Callback based iterator, cheapest way to read
+// all elements in a map. fn MUST NOT access the map, see IterCb.
+func (v ReadOnlyMap) IterCb(fn IterCb) {
+	v.m.IterCb(fn)
+}
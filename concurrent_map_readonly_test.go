@@ -0,0 +1,34 @@
+package cmap
+
+import "testing"
+
+func TestReadOnlyView(t *testing.T) {
+	m := New(64)
+	m.Set("elephant", Animal{"elephant"})
+	view := m.ReadOnlyView()
+
+	if v, ok := view.Get("elephant"); !ok || v != (Animal{"elephant"}) {
+		t.Error("view should see the owner's elements.")
+	}
+
+	// Updates of the owner are visible through the view.
+	m.Set("monkey", Animal{"monkey"})
+	m.Remove("elephant")
+	if !view.Has("monkey") || view.Has("elephant") || view.Count() != 1 {
+		t.Error("view should reflect live updates.")
+	}
+	if keys := view.Keys(); len(keys) != 1 || keys[0] != "monkey" {
+		t.Error("unexpected keys", keys)
+	}
+
+	count := 0
+	for range view.Iter() {
+		count++
+	}
+	view.IterCb(func(key string, v interface{}) {
+		count++
+	})
+	if count != 2 {
+		t.Error("Expecting both iterators to yield the monkey.")
+	}
+}
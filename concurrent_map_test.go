@@ -1,12 +1,24 @@
 package cmap
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"hash/fnv"
+	"math"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cespare/xxhash"
 )
@@ -26,6 +38,554 @@ func TestMapCreation(t *testing.T) {
 	}
 }
 
+func TestNewDefault(t *testing.T) {
+	SHARDS_COUNT = 2
+	defer func() {
+		SHARDS_COUNT = 32
+	}()
+
+	if m := NewDefault(); m.Shards != 2 || len(m.HashMap) != 2 {
+		t.Error("NewDefault should use SHARDS_COUNT shards.")
+	}
+
+	if m := New(64); m.Shards != 64 || len(m.HashMap) != 64 {
+		t.Error("New should ignore SHARDS_COUNT.")
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var m ConcurrentHashMap
+	if m.Count() != 0 || m.Has("elephant") {
+		t.Error("zero map should be empty.")
+	}
+
+	m.Set("elephant", Animal{"elephant"})
+	if v, ok := m.Get("elephant"); !ok || v != (Animal{"elephant"}) {
+		t.Error("zero map should be usable.")
+	}
+	if m.Shards != SHARDS_COUNT || len(m.HashMap) != SHARDS_COUNT {
+		t.Error("zero map should get SHARDS_COUNT shards.")
+	}
+
+	// Concurrent first use initializes the map only once.
+	var z ConcurrentHashMap
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			z.Set(strconv.Itoa(g), g)
+		}(g)
+	}
+	wg.Wait()
+	if z.Count() != 8 || z.Len() != 8 {
+		t.Error("Expecting 8 elements, got", z.Count())
+	}
+}
+
+func TestAdoptExportedFields(t *testing.T) {
+	shards := makeShards(4, Options{})
+	shards[0].items["a"] = 1
+	m := &ConcurrentHashMap{Shards: 4, HashMap: shards}
+	if m.Len() != 1 || m.Count() != 1 {
+		t.Error("adopted shards should be counted.")
+	}
+
+	sized := &ConcurrentHashMap{Shards: 8}
+	sized.Set("a", 1)
+	if sized.Shards != 8 || len(sized.HashMap) != 8 || len(sized.ShardCounts()) != 8 {
+		t.Error("a map without shards should get Shards shards, got", sized.Shards)
+	}
+}
+
+func TestNewChecked(t *testing.T) {
+	if m, err := NewChecked(8); err != nil || m.Shards != 8 {
+		t.Error("Expecting a map with 8 shards, got error", err)
+	}
+	for _, shards := range []int{0, -1} {
+		if m, err := NewChecked(shards); err != ErrInvalidShards || m != nil {
+			t.Error("Expecting ErrInvalidShards for", shards, "shards, got", err)
+		}
+	}
+
+	defer func() {
+		if recover() != ErrInvalidShards {
+			t.Error("New should panic with ErrInvalidShards.")
+		}
+	}()
+	New(0)
+}
+
+func TestConstructorsRejectInvalidShards(t *testing.T) {
+	constructors := map[string]func(){
+		"Resize":            func() { New(4).Resize(0) },
+		"NewBounded":        func() { NewBounded(0, 10) },
+		"NewG":              func() { NewG[int](0) },
+		"NewKV":             func() { NewKV[int, int](-1, HashInteger[int]) },
+		"NewIntMap":         func() { NewIntMap(0) },
+		"NewWithExpiration": func() { NewWithExpiration(0, 0) },
+	}
+	for name, fn := range constructors {
+		func() {
+			defer func() {
+				if r := recover(); r != ErrInvalidShards {
+					t.Error(name, "should panic with ErrInvalidShards, got", r)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestNewWithCapacity(t *testing.T) {
+	m := NewWithCapacity(8, 1000)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	if m.Shards != 8 || m.Count() != 1000 {
+		t.Error("Expecting 1000 elements in 8 shards.")
+	}
+
+	// Out of range hints are clamped.
+	if NewWithCapacity(8, -1).Count() != 0 || NewWithCapacity(1, 1<<30).Shards != 1 {
+		t.Error("invalid hints should be ignored.")
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	m := NewWithOptions(Options{})
+	if m.Shards != SHARDS_COUNT || m.HashMap[0].writeHeavy {
+		t.Error("zero Options should match NewDefault.")
+	}
+
+	m = NewWithOptions(Options{Shards: 8, WriteHeavy: true})
+	if m.Shards != 8 || !m.HashMap[0].writeHeavy {
+		t.Error("Options weren't applied.")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(g*100 + i)
+				m.Set(key, i)
+				if v, ok := m.Get(key); !ok || v != i {
+					t.Error("element lost in write heavy map", key)
+				}
+				m.Count()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if m.Count() != 400 || len(m.Items()) != 400 {
+		t.Error("Expecting 400 elements.")
+	}
+
+	m.Resize(4)
+	if !m.HashMap[0].writeHeavy || !m.Clone().HashMap[0].writeHeavy {
+		t.Error("Resize and Clone should keep the lock type.")
+	}
+}
+
+func TestReadOptimized(t *testing.T) {
+	m := NewWithOptions(Options{Shards: 8, ReadOptimized: true})
+	if !m.HashMap[0].readOptimized {
+		t.Error("Options weren't applied.")
+	}
+
+	// New keys are found under the lock until Get missed them often enough.
+	publish := func(key string) {
+		shard := m.GetShard(key)
+		for i := 0; i <= len(shard.items) && shard.unpublished.Load(); i++ {
+			if _, ok := m.Get(key); !ok {
+				t.Error("Get should see new keys.")
+			}
+		}
+		if shard.unpublished.Load() || shard.view()[key] == nil {
+			t.Error("new keys should be published once Get missed them often enough.")
+		}
+	}
+
+	m.Set("elephant", Animal{"elephant"})
+	publish("elephant")
+	published := m.GetShard("elephant").view()
+	m.Set("elephant", Animal{"mammoth"})
+	if e := m.GetShard("elephant").view()["elephant"]; e == nil || e != published["elephant"] {
+		t.Error("updates of existing keys shouldn't publish the shard again.")
+	}
+	if v, ok := m.Get("elephant"); !ok || v != (Animal{"mammoth"}) {
+		t.Error("Get should see the latest write, got", v)
+	}
+	m.Remove("elephant")
+	if _, ok := m.Get("elephant"); ok {
+		t.Error("Get should see removals.")
+	}
+	m.Set("elephant", nil)
+	if v, ok := m.Get("elephant"); !ok || v != nil {
+		t.Error("Get should see keys set again, got", v, ok)
+	}
+
+	m.Set("cat", Animal{"cat"})
+	if v, ok := m.Get("cat"); !ok || v != (Animal{"cat"}) {
+		t.Error("Get should see new keys, got", v)
+	}
+	publish("cat")
+	m.WithShardLock("cat", func(items map[string]interface{}) {
+		items["cat"] = Animal{"lion"}
+	})
+	if v, _ := m.Get("cat"); v != (Animal{"lion"}) {
+		t.Error("Get should see changes of WithShardLock, got", v)
+	}
+	m.Clear()
+	if _, ok := m.Get("cat"); ok {
+		t.Error("Get should see Clear.")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(g*100 + i)
+				m.Set(key, i)
+				if v, ok := m.Get(key); !ok || v != i {
+					t.Error("element lost in read optimized map", key)
+				}
+				m.Get(strconv.Itoa(i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if m.Count() != 400 || len(m.Items()) != 400 {
+		t.Error("Expecting 400 elements.")
+	}
+
+	m.Resize(4)
+	clone := m.Clone()
+	for _, mm := range []*ConcurrentHashMap{m, clone} {
+		if !mm.HashMap[0].readOptimized {
+			t.Error("Resize and Clone should keep ReadOptimized.")
+		}
+		if v, ok := mm.Get("142"); !ok || v != 42 {
+			t.Error("Get should see elements moved by Resize and Clone, got", v)
+		}
+	}
+
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrConflictingOptions) {
+			t.Error("Expecting ErrConflictingOptions, got", err)
+		}
+	}()
+	NewWithOptions(Options{ReadOptimized: true, TrackAccess: true})
+}
+
+type countingObserver struct {
+	sets, hits, misses, removes atomic.Int64
+}
+
+func (o *countingObserver) OnSet(key string) { o.sets.Add(1) }
+func (o *countingObserver) OnGet(key string, hit bool) {
+	if hit {
+		o.hits.Add(1)
+	} else {
+		o.misses.Add(1)
+	}
+}
+func (o *countingObserver) OnRemove(key string) { o.removes.Add(1) }
+
+func TestWatch(t *testing.T) {
+	m := New(64)
+	events, cancel := m.Watch("elephant")
+	other, cancelOther := m.Watch("elephant")
+	defer cancelOther()
+
+	m.Set("elephant", Animal{"elephant"})
+	m.Set("monkey", Animal{"monkey"})
+	m.Upsert("elephant", Animal{"mammoth"}, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		return newValue
+	})
+	m.Remove("elephant")
+	m.Remove("elephant")
+	m.Set("elephant", 1)
+	m.Clear()
+
+	expected := []Event{
+		{EventSet, Animal{"elephant"}},
+		{EventSet, Animal{"mammoth"}},
+		{EventRemoved, Animal{"mammoth"}},
+		{EventSet, 1},
+		{EventRemoved, 1},
+	}
+	for _, e := range expected {
+		if got := <-events; got != e {
+			t.Error("Expecting", e, "got", got)
+		}
+	}
+	if len(events) != 0 || len(other) != len(expected) {
+		t.Error("unexpected number of events", len(events), len(other))
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("cancel should close the channel.")
+	}
+	m.Set("elephant", 2)
+	if len(other) != len(expected)+1 {
+		t.Error("remaining watchers should still be notified.")
+	}
+}
+
+func TestWatchDropsWhenFull(t *testing.T) {
+	m := New(1)
+	events, cancel := m.Watch("counter")
+	defer cancel()
+
+	// Nobody reads events, writers must not block.
+	for i := 0; i < 10*watchBuffer; i++ {
+		m.IncrementInt("counter", 1)
+	}
+	if len(events) != watchBuffer {
+		t.Error("Expecting a full channel, got", len(events))
+	}
+	if e := <-events; e != (Event{EventSet, int64(1)}) {
+		t.Error("oldest events should be kept, got", e)
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := New(4)
+	if stats := m.Stats(); stats.Count != 0 || len(stats.ShardCounts) != 4 || stats.Ops != nil {
+		t.Error("unexpected stats of an empty map", stats)
+	}
+
+	o := &OpCounters{}
+	m.SetObserver(o)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	m.Get("42")
+	m.Get("unicorn")
+	m.Remove("42")
+
+	stats := m.Stats()
+	total := 0
+	for _, c := range stats.ShardCounts {
+		total += c
+	}
+	if stats.Count != 99 || total != 99 {
+		t.Error("Expecting 99 elements, got", stats.Count, total)
+	}
+	if stats.Ops == nil || *stats.Ops != (OpCounts{Sets: 100, Hits: 1, Misses: 1, Removes: 1}) {
+		t.Error("unexpected operation counters", stats.Ops)
+	}
+
+	if _, err := json.Marshal(stats); err != nil {
+		t.Error("Stats should marshal to JSON", err)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	m := New(64)
+	o := &countingObserver{}
+	m.SetObserver(o)
+
+	m.Set("elephant", Animal{"elephant"})
+	m.MSet(map[string]interface{}{"monkey": Animal{"monkey"}, "dog": Animal{"dog"}})
+	m.Get("elephant")
+	m.Get("unicorn")
+	m.Remove("monkey")
+	m.Pop("dog")
+	m.Remove("unicorn")
+	if o.sets.Load() != 3 || o.hits.Load() != 1 || o.misses.Load() != 1 || o.removes.Load() != 2 {
+		t.Error("unexpected observer counts", o.sets.Load(), o.hits.Load(), o.misses.Load(), o.removes.Load())
+	}
+
+	// Every method writing or removing elements is reported.
+	m.Upsert("elephant", Animal{"mammoth"}, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		return newValue
+	})
+	m.SetIfAbsent("elephant", Animal{"elephant"})
+	m.SetIfAbsent("monkey", Animal{"monkey"})
+	m.IncrementInt("counter", 1)
+	m.MSetWithPolicy(map[string]interface{}{"dog": 1, "cat": 2}, Overwrite)
+	m.Merge(New(4), nil)
+	if o.sets.Load() != 8 {
+		t.Error("Expecting 8 sets, got", o.sets.Load())
+	}
+	m.MRemove([]string{"dog", "unicorn"})
+	m.RemoveIf("cat", func(value interface{}, exists bool) bool { return true })
+	m.PopIf("monkey", func(value interface{}) bool { return false })
+	if o.removes.Load() != 4 {
+		t.Error("Expecting 4 removes, got", o.removes.Load())
+	}
+	m.Clear()
+	if o.removes.Load() != 7 {
+		t.Error("Clear should report every removed element, got", o.removes.Load())
+	}
+
+	m.SetObserver(nil)
+	m.Set("elephant", Animal{"elephant"})
+	m.Get("elephant")
+	if o.sets.Load() != 8 || o.hits.Load() != 1 {
+		t.Error("removed observer shouldn't be notified.")
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	m := NewWithOptions(Options{Shards: 8, TrackAccess: true})
+	for i := 0; i < 10; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	for i := 0; i < 10; i++ {
+		// Key i is read i times.
+		for j := 0; j < i; j++ {
+			m.Get(strconv.Itoa(i))
+		}
+	}
+	m.Get("missing")
+
+	hot := m.HotKeys(3)
+	if len(hot) != 3 || hot[0] != (KeyCount{"9", 9}) || hot[1] != (KeyCount{"8", 8}) || hot[2] != (KeyCount{"7", 7}) {
+		t.Error("unexpected hot keys", hot)
+	}
+	if len(m.HotKeys(100)) != 9 {
+		t.Error("only keys which were read should be reported.")
+	}
+
+	m.Remove("9")
+	m.Resize(3)
+	if hot := m.HotKeys(1); hot[0] != (KeyCount{"8", 8}) {
+		t.Error("removal should drop the count, Resize should keep the others", hot)
+	}
+
+	m.Clear()
+	if m.HotKeys(1) != nil {
+		t.Error("Clear should drop every count.")
+	}
+
+	if m.HotKeys(0) != nil || m.HotKeys(-1) != nil {
+		t.Error("HotKeys should return nil for n <= 0.")
+	}
+
+	plain := New(8)
+	plain.Set("a", 1)
+	plain.Get("a")
+	if plain.HotKeys(1) != nil {
+		t.Error("maps without TrackAccess shouldn't count.")
+	}
+}
+
+func TestNewCapped(t *testing.T) {
+	m := NewCapped(8, 2)
+	o := &countingObserver{}
+	m.SetObserver(o)
+	if !m.TrySet("a", 1) || !m.TrySet("b", 2) {
+		t.Error("map should accept elements until it is full.")
+	}
+	if m.TrySet("c", 3) || m.Has("c") {
+		t.Error("full map should reject new keys.")
+	}
+	if o.sets.Load() != 2 {
+		t.Error("the observer should see stored keys only, got", o.sets.Load())
+	}
+	if !m.TrySet("a", 10) {
+		t.Error("updates should succeed once the map is full.")
+	}
+	if v, _ := m.Get("a"); v != 10 {
+		t.Error("Expecting a to be updated, got", v)
+	}
+
+	m.Remove("b")
+	if !m.TrySet("c", 3) {
+		t.Error("removing an element should make room.")
+	}
+
+	if !New(8).TrySet("a", 1) {
+		t.Error("maps without a cap should accept everything.")
+	}
+
+	empty := NewCapped(4, 0)
+	if empty.TrySet("a", 1) || empty.Len() != 0 {
+		t.Error("a map capped at 0 should reject every key.")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("NewCapped should panic on a negative maxTotal.")
+		}
+	}()
+	NewCapped(4, -1)
+}
+
+func TestTimeouts(t *testing.T) {
+	m := New(1)
+	if !m.TrySetTimeout("elephant", Animal{"elephant"}, time.Millisecond) {
+		t.Error("TrySetTimeout should store when the shard is free.")
+	}
+	if v, ok, locked := m.TryGetTimeout("elephant", time.Millisecond); !locked || !ok || v != (Animal{"elephant"}) {
+		t.Error("TryGetTimeout should find the element when the shard is free.")
+	}
+	if _, ok, locked := m.TryGetTimeout("monkey", time.Millisecond); !locked || ok {
+		t.Error("TryGetTimeout should report missing keys.")
+	}
+
+	// Hold the only shard.
+	m.WithShardLock("elephant", func(items map[string]interface{}) {
+		start := time.Now()
+		if m.TrySetTimeout("monkey", Animal{"monkey"}, 5*time.Millisecond) {
+			t.Error("TrySetTimeout shouldn't store while the shard is locked.")
+		}
+		if _, ok, locked := m.TryGetTimeout("elephant", 5*time.Millisecond); locked || ok {
+			t.Error("TryGetTimeout should give up while the shard is locked.")
+		}
+		if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Second {
+			t.Error("operations should wait for their timeout, took", elapsed)
+		}
+	})
+	if m.Has("monkey") || m.Len() != 1 {
+		t.Error("a timed out TrySetTimeout shouldn't store anything.")
+	}
+
+	// The lock is released while waiting.
+	done := make(chan struct{})
+	go m.WithShardLock("elephant", func(items map[string]interface{}) {
+		close(done)
+		time.Sleep(5 * time.Millisecond)
+	})
+	<-done
+	if !m.TrySetTimeout("monkey", Animal{"monkey"}, time.Second) || !m.Has("monkey") {
+		t.Error("TrySetTimeout should store once the shard is released.")
+	}
+}
+
+func TestNewCappedConcurrent(t *testing.T) {
+	const maxTotal = 50
+	m := NewCapped(8, maxTotal)
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if m.TrySet(strconv.Itoa(g*100+i), i) {
+					accepted.Add(1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if accepted.Load() != maxTotal || m.Count() != maxTotal || m.Len() != maxTotal {
+		t.Error("Expecting exactly", maxTotal, "elements, got", m.Count())
+	}
+}
+
 func TestInsert(t *testing.T) {
 	m := New(64)
 	elephant := Animal{"elephant"}
@@ -50,6 +610,25 @@ func TestInsertAbsent(t *testing.T) {
 	}
 }
 
+func TestInsertAbsentFunc(t *testing.T) {
+	m := New(64)
+	calls := 0
+	newElephant := func() interface{} {
+		calls++
+		return Animal{"elephant"}
+	}
+
+	if !m.SetIfAbsentFunc("elephant", newElephant) {
+		t.Error("SetIfAbsentFunc should store a missing entry.")
+	}
+	if m.SetIfAbsentFunc("elephant", newElephant) {
+		t.Error("map set a new value even the entry is already present")
+	}
+	if v, _ := m.Get("elephant"); v != (Animal{"elephant"}) || calls != 1 || m.Len() != 1 {
+		t.Error("fn should have been called only for the missing entry.")
+	}
+}
+
 func TestGet(t *testing.T) {
 	m := New(64)
 
@@ -85,6 +664,133 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestHasAllHasAny(t *testing.T) {
+	m := New(64)
+	m.Set("read", true)
+	m.Set("write", true)
+
+	if !m.HasAll("read", "write") || m.HasAll("read", "admin") {
+		t.Error("unexpected HasAll result.")
+	}
+	if !m.HasAny("admin", "write") || m.HasAny("admin", "root") {
+		t.Error("unexpected HasAny result.")
+	}
+	if !m.HasAll() || m.HasAny() {
+		t.Error("HasAll of no keys should be true, HasAny false.")
+	}
+}
+
+func TestGetDefault(t *testing.T) {
+	m := New(64)
+	m.Set("elephant", Animal{"elephant"})
+	m.Set("nothing", nil)
+
+	if v := m.GetDefault("elephant", Animal{"default"}); v != (Animal{"elephant"}) {
+		t.Error("GetDefault should return the stored value.")
+	}
+	if v := m.GetDefault("monkey", Animal{"default"}); v != (Animal{"default"}) {
+		t.Error("GetDefault should return the default for missing keys.")
+	}
+	if v := m.GetDefault("nothing", Animal{"default"}); v != nil {
+		t.Error("a stored nil is a value, not a missing key.")
+	}
+}
+
+func TestGetOrError(t *testing.T) {
+	m := New(64)
+	m.Set("elephant", Animal{"elephant"})
+	m.Set("nothing", nil)
+
+	if v, err := m.GetOrError("elephant"); err != nil || v != (Animal{"elephant"}) {
+		t.Error("GetOrError should return the stored value.", v, err)
+	}
+	if v, err := m.GetOrError("nothing"); err != nil || v != nil {
+		t.Error("a key set to nil isn't missing.", err)
+	}
+	v, err := m.GetOrError("monkey")
+	if !errors.Is(err, ErrKeyNotFound) || v != nil {
+		t.Error("expecting ErrKeyNotFound, got", err)
+	}
+	if !strings.Contains(err.Error(), `"monkey"`) {
+		t.Error("error should name the missing key:", err)
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	m := New(64)
+	m.Set("name", "elephant")
+	m.Set("legs", 4)
+	m.Set("wild", true)
+	m.Set("weight", int64(6000))
+
+	if v, ok := m.GetString("name"); !ok || v != "elephant" {
+		t.Error("GetString should return the stored string.")
+	}
+	if v, ok := m.GetInt("legs"); !ok || v != 4 {
+		t.Error("GetInt should return the stored int.")
+	}
+	if v, ok := m.GetBool("wild"); !ok || !v {
+		t.Error("GetBool should return the stored bool.")
+	}
+
+	// Type mismatches and missing keys look the same.
+	if v, ok := m.GetString("legs"); ok || v != "" {
+		t.Error("GetString shouldn't convert an int.")
+	}
+	if _, ok := m.GetInt("weight"); ok {
+		t.Error("GetInt shouldn't match an int64.")
+	}
+	if _, ok := m.GetBool("missing"); ok {
+		t.Error("GetBool should report missing keys.")
+	}
+}
+
+func TestNilValue(t *testing.T) {
+	for _, opts := range []Options{{Shards: 8}, {Shards: 8, ReadOptimized: true}} {
+		m := NewWithOptions(opts)
+		m.Set("nil", nil)
+		var typedNil *Animal
+		m.Set("typed nil", typedNil)
+
+		if v, ok := m.Get("nil"); !ok || v != nil {
+			t.Error("Get should report a key set to nil as present.")
+		}
+		if v, ok := m.Get("typed nil"); !ok || v != interface{}(typedNil) || v == nil {
+			t.Error("Get should return the typed nil as stored.")
+		}
+		if v, ok := m.Get("missing"); ok || v != nil {
+			t.Error("Get should report missing keys as absent.")
+		}
+		if !m.Has("nil") || !m.HasAll("nil", "typed nil") || m.HasAny("missing") {
+			t.Error("Has should report keys set to nil as present.")
+		}
+		if m.Count() != 2 || m.Len() != 2 || len(m.Keys()) != 2 || len(m.Items()) != 2 {
+			t.Error("keys set to nil should be counted.")
+		}
+		if v, ok, _ := m.TryGetTimeout("nil", time.Second); !ok || v != nil {
+			t.Error("TryGetTimeout should report a key set to nil as present.")
+		}
+		if _, found := m.GetOrdered([]string{"nil", "missing"}); !found[0] || found[1] {
+			t.Error("GetOrdered should report a key set to nil as found.")
+		}
+		if items := m.MGet([]string{"nil", "missing"}); len(items) != 1 {
+			t.Error("MGet should return keys set to nil.")
+		}
+		if m.SetIfAbsent("nil", 1) {
+			t.Error("SetIfAbsent shouldn't overwrite a key set to nil.")
+		}
+		if v, loaded := m.GetOrSet("nil", 1); !loaded || v != nil {
+			t.Error("GetOrSet should return the stored nil.")
+		}
+		if v, ok := m.Pop("nil"); !ok || v != nil || m.Has("nil") {
+			t.Error("Pop should remove a key set to nil.")
+		}
+		if j, _ := json.Marshal(m); string(j) != `{"typed nil":null}` {
+			t.Error("unexpected json", string(j))
+		}
+	}
+}
+
 func TestHas(t *testing.T) {
 	m := New(64)
 
@@ -127,6 +833,34 @@ func TestRemove(t *testing.T) {
 	m.Remove("noone")
 }
 
+func TestPopWithCleanup(t *testing.T) {
+	m := New(64)
+	m.Set("monkey", Animal{"monkey"})
+
+	var cleaned []interface{}
+	cleanup := func(v interface{}) { cleaned = append(cleaned, v) }
+
+	if v, ok := m.PopWithCleanup("monkey", cleanup); !ok || v != (Animal{"monkey"}) {
+		t.Error("PopWithCleanup didn't return the stored value.")
+	}
+	if _, ok := m.PopWithCleanup("monkey", cleanup); ok {
+		t.Error("PopWithCleanup keeps finding monkey.")
+	}
+	if len(cleaned) != 1 || cleaned[0] != (Animal{"monkey"}) || m.Has("monkey") {
+		t.Error("cleanup should have run exactly once with the removed value.")
+	}
+
+	// The shard is unlocked even if cleanup panics.
+	m.Set("dog", Animal{"dog"})
+	func() {
+		defer func() { recover() }()
+		m.PopWithCleanup("dog", func(v interface{}) { panic("boom") })
+	}()
+	if m.Has("dog") {
+		t.Error("dog should have been removed.")
+	}
+}
+
 func TestPop(t *testing.T) {
 	m := New(64)
 
@@ -178,14 +912,393 @@ func TestCount(t *testing.T) {
 	}
 }
 
-func TestIsEmpty(t *testing.T) {
+func TestCountWhere(t *testing.T) {
 	m := New(64)
-
-	if m.IsEmpty() == false {
-		t.Error("new map should be empty")
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
 	}
 
-	m.Set("elephant", Animal{"elephant"})
+	even := m.CountWhere(func(key string, v interface{}) bool {
+		return v.(int)%2 == 0
+	})
+	if even != 50 {
+		t.Error("Expecting 50 even values, got", even)
+	}
+
+	if n := m.CountWhere(func(string, interface{}) bool { return true }); n != m.Count() {
+		t.Error("an always true predicate should count everything.")
+	}
+}
+
+func TestCountWhereConcurrent(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	even := func(key string, v interface{}) bool {
+		return v.(int)%2 == 0
+	}
+	if n := m.CountWhereConcurrent(even); n != 500 || n != m.CountWhere(even) {
+		t.Error("Expecting 500 even values, got", n)
+	}
+	if n := New(4).CountWhereConcurrent(even); n != 0 {
+		t.Error("empty map should count nothing, got", n)
+	}
+}
+
+func TestLen(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	// Overwrites and conditional operations which don't change membership.
+	m.Set("0", Animal{"zero"})
+	m.SetIfAbsent("1", Animal{"one"})
+	m.UpdateCb("missing", 1, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		return newValue
+	})
+	m.Update("missing", 1)
+	m.Remove("missing")
+	m.RemoveIf("2", func(value interface{}, exists bool) bool { return false })
+	if m.Len() != 100 || m.Len() != m.Count() {
+		t.Error("Len should only change when membership does, got", m.Len())
+	}
+
+	m.SetIfAbsent("new", 1)
+	m.Upsert("upserted", 1, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		return newValue
+	})
+	m.Pop("3")
+	m.MRemove([]string{"4", "5", "missing"})
+	m.Compute("6", func(oldValue interface{}, loaded bool) (interface{}, bool) { return nil, true })
+	if m.Len() != 98 || m.Len() != m.Count() {
+		t.Error("Len and Count should agree, got", m.Len(), m.Count())
+	}
+
+	if c := m.Clone(); c.Len() != 98 {
+		t.Error("clone should keep the count.")
+	}
+
+	m.Resize(8)
+	if m.Len() != 98 {
+		t.Error("Resize shouldn't change the count.")
+	}
+
+	m.Clear()
+	if m.Len() != 0 {
+		t.Error("Expecting Len to be zero once map was cleared.")
+	}
+}
+
+func TestLenConcurrent(t *testing.T) {
+	m := New(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(i % 50)
+				m.SetIfAbsent(key, i)
+				m.Set(key, i)
+				m.Pop(key)
+				m.GetOrSet(key, i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if m.Len() != m.Count() {
+		t.Error("Len drifted from Count", m.Len(), m.Count())
+	}
+}
+
+func TestShardCounts(t *testing.T) {
+	m := New(4)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	counts := m.ShardCounts()
+	if len(counts) != 4 {
+		t.Error("Expecting one count per shard.")
+	}
+
+	total := 0
+	for i, c := range counts {
+		if c != len(m.HashMap[i].items) {
+			t.Error("count differs from shard", i)
+		}
+		total += c
+	}
+	if total != 100 {
+		t.Error("shard counts should add up to Count.")
+	}
+}
+
+func TestContentionStats(t *testing.T) {
+	if New(8).ContentionStats() != nil {
+		t.Error("maps without TrackContention shouldn't report statistics.")
+	}
+
+	m := NewWithOptions(Options{Shards: 1, TrackContention: true})
+	m.Set("a", 1)
+	m.Get("a")
+	stats := m.ContentionStats()
+	if len(stats) != 1 || stats[0] != (ShardContention{2, 0}) {
+		t.Error("Expecting two uncontended acquisitions, got", stats)
+	}
+
+	// Hold the only shard, so the next Get has to wait.
+	m.HashMap[0].lock()
+	done := make(chan struct{})
+	go func() {
+		m.Get("a")
+		close(done)
+	}()
+	for m.ContentionStats()[0].Contended == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	m.HashMap[0].unlock()
+	<-done
+
+	if stats := m.ContentionStats(); stats[0].Acquired != 4 || stats[0].Contended != 1 {
+		t.Error("Expecting one contended acquisition, got", stats)
+	}
+}
+
+func TestShardLoadStats(t *testing.T) {
+	m := New(2)
+	// "a" lands in one shard, "b" and "d" in the other.
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("d", 3)
+	counts := m.ShardCounts()
+
+	min, max, mean, stddev := m.ShardLoadStats()
+	if min != 1 || max != 2 || min+max != counts[0]+counts[1] {
+		t.Error("unexpected min/max", min, max)
+	}
+	if mean != 1.5 || stddev != 0.5 {
+		t.Error("unexpected mean/stddev", mean, stddev)
+	}
+
+	min, max, mean, stddev = New(8).ShardLoadStats()
+	if min != 0 || max != 0 || mean != 0 || stddev != 0 {
+		t.Error("empty map should have no load.")
+	}
+}
+
+func TestAnalyzeDistribution(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	r := AnalyzeDistribution(keys, 16)
+	m := New(16)
+	for _, key := range keys {
+		m.Set(key, nil)
+	}
+	if !reflect.DeepEqual(r.Counts, m.ShardCounts()) {
+		t.Error("analysis should match real placement", r.Counts, m.ShardCounts())
+	}
+	min, max, mean, stddev := m.ShardLoadStats()
+	if r.Min != min || r.Max != max || r.Mean != mean || r.StdDev != stddev {
+		t.Error("analysis should match ShardLoadStats", r)
+	}
+	if r.Skew != float64(max)/mean || r.Skew < 1 {
+		t.Error("unexpected skew", r.Skew)
+	}
+
+	if r := AnalyzeDistribution(nil, 4); len(r.Counts) != 4 || r.Skew != 0 {
+		t.Error("no keys should report empty shards", r)
+	}
+
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrInvalidShards) {
+			t.Error("expecting ErrInvalidShards, got", err)
+		}
+	}()
+	AnalyzeDistribution(keys, 0)
+}
+
+func TestClear(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	m.Clear()
+
+	if m.Count() != 0 {
+		t.Error("Expecting count to be zero once map was cleared.")
+	}
+
+	if m.Shards != 64 || len(m.HashMap) != 64 {
+		t.Error("Clear should keep the shard layout.")
+	}
+
+	m.Set("elephant", Animal{"elephant"})
+	if m.Count() != 1 {
+		t.Error("map should be usable after Clear.")
+	}
+}
+
+func TestPopAll(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	items := m.PopAll()
+	if len(items) != 100 || items["42"] != 42 {
+		t.Error("PopAll should return every element.")
+	}
+	if m.Count() != 0 || m.Len() != 0 {
+		t.Error("map should be empty after PopAll.")
+	}
+
+	m.Set("a", 1)
+	if items := m.PopAll(); len(items) != 1 || len(m.PopAll()) != 0 {
+		t.Error("map should be usable after PopAll.")
+	}
+}
+
+func TestDrainInto(t *testing.T) {
+	m := New(8)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	// Unbuffered, every send waits for the consumer.
+	out := make(chan Tuple)
+	done := make(chan struct{})
+	go func() {
+		m.DrainInto(out)
+		close(done)
+	}()
+
+	seen := make(map[string]bool)
+	for len(seen) < 100 {
+		item := <-out
+		if seen[item.Key] || strconv.Itoa(item.Val.(int)) != item.Key {
+			t.Error("unexpected or duplicate element", item)
+		}
+		seen[item.Key] = true
+		if m.Has(item.Key) {
+			t.Error("sent element should have been removed", item.Key)
+		}
+	}
+	<-done
+
+	if m.Count() != 0 || m.Len() != 0 {
+		t.Error("map should be empty once DrainInto returns.")
+	}
+}
+
+func TestTrimShards(t *testing.T) {
+	m := NewWithOptions(Options{Shards: 4, TrackAccess: true})
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	m.Get("42")
+	for i := 100; i < 10000; i++ {
+		m.Remove(strconv.Itoa(i))
+	}
+
+	old := m.HashMap[0].items
+	m.TrimShards()
+	if reflect.ValueOf(m.HashMap[0].items).Pointer() == reflect.ValueOf(old).Pointer() {
+		t.Error("TrimShards should replace the shard maps.")
+	}
+	if m.Count() != 100 || m.Len() != 100 {
+		t.Error("TrimShards shouldn't change the elements.")
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Error("element lost while trimming", i)
+		}
+	}
+	if hot := m.HotKeys(1); hot[0].Key != "42" || hot[0].Count != 2 {
+		t.Error("TrimShards should keep access counts", hot)
+	}
+}
+
+func TestAutoShrink(t *testing.T) {
+	m := NewWithOptions(Options{Shards: 1, AutoShrink: true})
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	shard := m.HashMap[0]
+	old := reflect.ValueOf(shard.items).Pointer()
+
+	// 250 elements left is still a quarter of the peak.
+	for i := 250; i < 1000; i++ {
+		m.Remove(strconv.Itoa(i))
+	}
+	if reflect.ValueOf(shard.items).Pointer() != old {
+		t.Error("shard shouldn't be rebuilt before dropping below a quarter of its peak.")
+	}
+
+	m.Remove("249")
+	if reflect.ValueOf(shard.items).Pointer() == old || shard.peak != 249 {
+		t.Error("shard should have been rebuilt, peak is", shard.peak)
+	}
+	if m.Count() != 249 || m.Len() != 249 {
+		t.Error("AutoShrink shouldn't change the elements.")
+	}
+	for i := 0; i < 249; i++ {
+		if v, ok := m.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Error("element lost while shrinking", i)
+		}
+	}
+
+	// Shards filled as a whole track their peak too.
+	moved := NewWithOptions(Options{Shards: 4, AutoShrink: true})
+	for i := 0; i < 1000; i++ {
+		moved.Set(strconv.Itoa(i), i)
+	}
+	moved.Resize(1)
+	clone := moved.Clone()
+	restored := NewWithOptions(Options{Shards: 1, AutoShrink: true})
+	restored.RestoreShards([]map[string]interface{}{moved.ToMap()})
+	for _, mm := range []*ConcurrentHashMap{moved, clone, restored} {
+		shard := mm.HashMap[0]
+		if shard.peak != 1000 {
+			t.Error("Expecting a peak of 1000, got", shard.peak)
+		}
+		for i := 10; i < 1000; i++ {
+			mm.Remove(strconv.Itoa(i))
+		}
+		if shard.peak >= 250 {
+			t.Error("shard should have been rebuilt, peak is", shard.peak)
+		}
+	}
+
+	// Off by default.
+	plain := New(1)
+	for i := 0; i < 1000; i++ {
+		plain.Set(strconv.Itoa(i), i)
+	}
+	old = reflect.ValueOf(plain.HashMap[0].items).Pointer()
+	for i := 1; i < 1000; i++ {
+		plain.Remove(strconv.Itoa(i))
+	}
+	if reflect.ValueOf(plain.HashMap[0].items).Pointer() != old {
+		t.Error("maps without AutoShrink shouldn't be rebuilt.")
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	m := New(64)
+
+	if m.IsEmpty() == false {
+		t.Error("new map should be empty")
+	}
+
+	m.Set("elephant", Animal{"elephant"})
 
 	if m.IsEmpty() != false {
 		t.Error("map shouldn't be empty.")
@@ -240,7 +1353,25 @@ func TestBufferedIterator(t *testing.T) {
 	}
 }
 
-func TestIterCb(t *testing.T) {
+func TestIterSorted(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	keys := make([]string, 0, 100)
+	for item := range m.IterSorted() {
+		if item.Val != (Animal{item.Key}) {
+			t.Error("value doesn't belong to", item.Key)
+		}
+		keys = append(keys, item.Key)
+	}
+	if len(keys) != 100 || !sort.StringsAreSorted(keys) {
+		t.Error("Expecting 100 elements in ascending key order.")
+	}
+}
+
+func TestIterWithContext(t *testing.T) {
 	m := New(64)
 
 	// Insert 100 elements.
@@ -249,21 +1380,102 @@ func TestIterCb(t *testing.T) {
 	}
 
 	counter := 0
-	// Iterate over elements.
-	m.IterCb(func(key string, v interface{}) {
-		_, ok := v.(Animal)
-		if !ok {
-			t.Error("Expecting an animal object")
+	for item := range m.IterWithContext(context.Background()) {
+		if item.Val == nil {
+			t.Error("Expecting an object.")
+		}
+		counter++
+	}
+
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+}
+
+func TestIterWithContextCancel(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := m.IterWithContext(ctx)
+	for range ch {
+		break
+	}
+	cancel()
+
+	// No draining, goroutines must go away on their own.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("iterator goroutines leaked after cancel.")
 		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Error("channel should be closed after cancel.")
+	}
+}
+
+func TestIterWithShard(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
 
+	counter := 0
+	for item := range m.IterWithShard() {
+		if item.Shard != m.ShardIndex(item.Key) {
+			t.Error("element", item.Key, "tagged with the wrong shard", item.Shard)
+		}
+		if item.Val != (Animal{item.Key}) {
+			t.Error("unexpected value for", item.Key)
+		}
 		counter++
-	})
+	}
 	if counter != 100 {
 		t.Error("We should have counted 100 elements.")
 	}
 }
 
-func TestIterConcurrentCb(t *testing.T) {
+func TestIterWithStop(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	ch, stop := m.IterWithStop()
+	counter := 0
+	for range ch {
+		counter++
+	}
+	stop()
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	before := runtime.NumGoroutine()
+	ch, stop = m.IterWithStop()
+	for range ch {
+		break
+	}
+	stop()
+	stop()
+
+	// No draining, goroutines must go away on their own.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("iterator goroutines leaked after stop.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIterCb(t *testing.T) {
 	m := New(64)
 
 	// Insert 100 elements.
@@ -271,48 +1483,377 @@ func TestIterConcurrentCb(t *testing.T) {
 		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
 	}
 
-	counter := int64(0)
+	counter := 0
 	// Iterate over elements.
-	m.IterConcurrentCb(func(key string, v interface{}) {
+	m.IterCb(func(key string, v interface{}) {
 		_, ok := v.(Animal)
 		if !ok {
 			t.Error("Expecting an animal object")
 		}
-		atomic.AddInt64(&counter, 1)
+
+		counter++
 	})
 	if counter != 100 {
 		t.Error("We should have counted 100 elements.")
 	}
 }
 
-func TestItems(t *testing.T) {
+func TestCopyIterCb(t *testing.T) {
 	m := New(64)
 
 	// Insert 100 elements.
 	for i := 0; i < 100; i++ {
-		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+		m.Set(strconv.Itoa(i), i)
 	}
 
-	items := m.Items()
-
-	if len(items) != 100 {
+	counter := 0
+	// The callback may write to the map, no lock is held while it runs.
+	m.CopyIterCb(func(key string, v interface{}) {
+		m.Set(key, v.(int)+1)
+		counter++
+	})
+	if counter != 100 {
 		t.Error("We should have counted 100 elements.")
 	}
+	if v, _ := m.Get("42"); v != 43 {
+		t.Error("callback should have updated the element, got", v)
+	}
 }
 
-func TestConcurrent(t *testing.T) {
+func TestIterCbBreak(t *testing.T) {
 	m := New(64)
-	ch := make(chan int)
-	const iterations = 1000
-	var a [iterations]int
-
-	// Using go routines insert 1000 ints into our map.
-	go func() {
-		for i := 0; i < iterations/2; i++ {
-			// Add item to map.
-			m.Set(strconv.Itoa(i), i)
 
-			// Retrieve item from map.
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	counter := 0
+	m.IterCbBreak(func(key string, v interface{}) bool {
+		counter++
+		return counter < 10
+	})
+	if counter != 10 {
+		t.Error("iteration should have stopped after 10 elements.")
+	}
+
+	counter = 0
+	m.IterCbBreak(func(key string, v interface{}) bool {
+		counter++
+		return true
+	})
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	// Every shard must have been unlocked.
+	m.Clear()
+}
+
+func TestIterConcurrentCb(t *testing.T) {
+	m := New(64)
+
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	counter := int64(0)
+	// Iterate over elements.
+	m.IterConcurrentCb(func(key string, v interface{}) {
+		_, ok := v.(Animal)
+		if !ok {
+			t.Error("Expecting an animal object")
+		}
+		atomic.AddInt64(&counter, 1)
+	})
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+}
+
+func TestIterConcurrentCbBreak(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	var calls atomic.Int64
+	var found atomic.Bool
+	m.IterConcurrentCbBreak(func(key string, v interface{}) bool {
+		calls.Add(1)
+		if key == "5000" {
+			found.Store(true)
+			return false
+		}
+		return true
+	})
+	if !found.Load() {
+		t.Error("the searched key should have been visited.")
+	}
+
+	calls.Store(0)
+	m.IterConcurrentCbBreak(func(key string, v interface{}) bool {
+		calls.Add(1)
+		return true
+	})
+	if calls.Load() != 10000 {
+		t.Error("Expecting every element to be visited, got", calls.Load())
+	}
+
+	calls.Store(0)
+	m.IterConcurrentCbBreak(func(key string, v interface{}) bool {
+		calls.Add(1)
+		return false
+	})
+	// At most one call per shard, the others see the stop right away.
+	if calls.Load() > 64 {
+		t.Error("iteration didn't stop early,", calls.Load(), "calls")
+	}
+}
+
+func TestForEachShard(t *testing.T) {
+	m := New(8)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	next, total := 0, 0
+	m.ForEachShard(func(shardIndex int, items map[string]interface{}) {
+		if shardIndex != next {
+			t.Error("shards should be visited in index order.")
+		}
+		next++
+		for key := range items {
+			if m.HashMap[shardIndex] != m.GetShard(key) {
+				t.Error("element reported in the wrong shard", key)
+			}
+		}
+		total += len(items)
+	})
+	if next != 8 || total != 100 {
+		t.Error("Expecting every shard and element to be visited.")
+	}
+}
+
+func TestItems(t *testing.T) {
+	m := New(64)
+
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	items := m.Items()
+
+	if len(items) != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+}
+
+func TestItemsLike(t *testing.T) {
+	m := New(64)
+	for _, key := range []string{"user:1", "user:2", "superuser:1", "admin:1"} {
+		m.Set(key, key)
+	}
+
+	if items := m.ItemsLike("user"); len(items) != 3 {
+		t.Error("ItemsLike should match on substrings.")
+	}
+
+	items := m.ItemsPrefix("user")
+	if len(items) != 2 || items["user:1"] != "user:1" || items["user:2"] != "user:2" {
+		t.Error("ItemsPrefix should only match on prefixes.")
+	}
+
+	items = m.ItemsRegex(regexp.MustCompile(`^(super)?user:1$`))
+	if len(items) != 2 || items["user:1"] == nil || items["superuser:1"] == nil {
+		t.Error("ItemsRegex should match on the regexp.")
+	}
+
+	if items := m.ItemsPrefix("nobody"); len(items) != 0 {
+		t.Error("ItemsPrefix shouldn't match anything.")
+	}
+}
+
+func TestItemsLikeOpts(t *testing.T) {
+	m := New(64)
+	for _, key := range []string{"User:1", "user:2", "superUSER:1", "admin:1", "us"} {
+		m.Set(key, key)
+	}
+
+	tests := []struct {
+		opts     LikeOptions
+		expected []string
+	}{
+		{LikeOptions{}, []string{"user:2"}},
+		{LikeOptions{CaseInsensitive: true}, []string{"User:1", "superUSER:1", "user:2"}},
+		{LikeOptions{Anchored: true}, []string{"user:2"}},
+		{LikeOptions{CaseInsensitive: true, Anchored: true}, []string{"User:1", "user:2"}},
+	}
+	for _, test := range tests {
+		items := m.ItemsLikeOpts("user", test.opts)
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("%+v: expecting %v, got %v", test.opts, test.expected, keys)
+		}
+	}
+
+	// Both case insensitive modes lower keys the same way: the Kelvin sign
+	// lowers to k, while the long s is already lower case.
+	m = New(64)
+	m.Set("\u212Aelvin", 1)
+	m.Set("\u017Ftop", 2)
+	for _, anchored := range []bool{false, true} {
+		opts := LikeOptions{CaseInsensitive: true, Anchored: anchored}
+		if len(m.ItemsLikeOpts("k", opts)) != 1 || len(m.ItemsLikeOpts("s", opts)) != 0 {
+			t.Errorf("%+v: inconsistent matching of non ASCII keys.", opts)
+		}
+	}
+}
+
+func TestRangeBetween(t *testing.T) {
+	m := New(64)
+	for _, key := range []string{"2022-12-31", "2023-01", "2023-01-15", "2023-02", "2023-02-01"} {
+		m.Set(key, key)
+	}
+
+	items := m.RangeBetween("2023-01", "2023-02")
+	if len(items) != 3 || items["2023-01"] == nil || items["2023-01-15"] == nil || items["2023-02"] == nil {
+		t.Error("Expecting both bounds to be included, got", items)
+	}
+
+	if items := m.RangeBetween("2023-02", "2023-01"); len(items) != 0 {
+		t.Error("an inverted range should be empty.")
+	}
+}
+
+func TestSyncMapInterop(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	sm := m.ToSyncMap()
+	count := 0
+	sm.Range(func(key, value interface{}) bool {
+		if value != (Animal{key.(string)}) {
+			t.Error("unexpected value for", key)
+		}
+		count++
+		return true
+	})
+	if count != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	sm.Store(42, "not a string key")
+	back := FromSyncMap(sm, 16)
+	if back.Shards != 16 || back.Count() != 100 {
+		t.Error("FromSyncMap should copy the 100 string keyed entries, got", back.Count())
+	}
+	if v, _ := back.Get("42"); v != (Animal{"42"}) {
+		t.Error("FromSyncMap lost an element.")
+	}
+}
+
+func TestToMap(t *testing.T) {
+	m := New(64)
+
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	items := m.ToMap()
+
+	if len(items) != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	for key, v := range m.Items() {
+		if items[key] != v {
+			t.Error("ToMap and Items differ on", key)
+		}
+	}
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	m := New(64)
+	// "a" and "b" live in different shards, "a" is always updated first,
+	// so no instant has b > a.
+	if m.GetShard("a") == m.GetShard("b") {
+		t.Fatal("a and b should be in different shards.")
+	}
+	m.Set("a", 0)
+	m.Set("b", 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 2000; i++ {
+			m.Set("a", i)
+			m.Set("b", i)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snap := m.SnapshotConsistent()
+		a, b := snap["a"].(int), snap["b"].(int)
+		if a != b && a != b+1 {
+			t.Fatal("snapshot mixes two states of the map", a, b)
+		}
+	}
+
+	if len(m.SnapshotConsistent()) != 2 {
+		t.Error("Expecting 2 elements in the snapshot.")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	m := New(64)
+
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	items := m.Filter(func(key string, v interface{}) bool {
+		return v.(int)%10 == 0
+	})
+
+	if len(items) != 10 {
+		t.Error("We should have matched 10 elements.")
+	}
+
+	for key, v := range items {
+		if key != strconv.Itoa(v.(int)) || v.(int)%10 != 0 {
+			t.Error("unexpected element", key, v)
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	m := New(64)
+	ch := make(chan int)
+	const iterations = 1000
+	var a [iterations]int
+
+	// Using go routines insert 1000 ints into our map.
+	go func() {
+		for i := 0; i < iterations/2; i++ {
+			// Add item to map.
+			m.Set(strconv.Itoa(i), i)
+
+			// Retrieve item from map.
 			val, _ := m.Get(strconv.Itoa(i))
 
 			// Write to channel inserted value.
@@ -359,13 +1900,35 @@ func TestConcurrent(t *testing.T) {
 	}
 }
 
+func TestString(t *testing.T) {
+	m := New(64)
+	m.Set("b", 2)
+	m.Set("a", Animal{"elephant"})
+	if s := m.String(); s != "ConcurrentHashMap(count=2)[a={elephant} b=2]" {
+		t.Error("unexpected String()", s)
+	}
+
+	if s := New(8).String(); s != "ConcurrentHashMap(count=0)[]" {
+		t.Error("unexpected String() for an empty map", s)
+	}
+
+	for i := 0; i < 150; i++ {
+		m.Set(fmt.Sprintf("k%03d", i), i)
+	}
+	s := m.String()
+	if !strings.HasPrefix(s, "ConcurrentHashMap(count=152)[a={elephant} b=2 k000=0") ||
+		!strings.HasSuffix(s, " k097=97 ...]") {
+		t.Error("String() should print the first 100 sorted elements", s)
+	}
+}
+
 func TestJsonMarshal(t *testing.T) {
 	SHARDS_COUNT = 2
 	defer func() {
 		SHARDS_COUNT = 32
 	}()
 	expected := "{\"a\":1,\"b\":2}"
-	m := New(64)
+	m := NewDefault()
 	m.Set("a", 1)
 	m.Set("b", 2)
 	j, err := json.Marshal(m)
@@ -379,73 +1942,445 @@ func TestJsonMarshal(t *testing.T) {
 	}
 }
 
-func TestKeys(t *testing.T) {
-	m := New(64)
+func TestJsonMarshalFunc(t *testing.T) {
+	m := New(4)
+	m.Set("ready", make(chan int))
+	m.Set("name", "elephant")
 
-	// Insert 100 elements.
-	for i := 0; i < 100; i++ {
-		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	if _, err := json.Marshal(m); err == nil {
+		t.Error("a channel shouldn't be marshaled without a MarshalFunc.")
 	}
 
-	keys := m.Keys()
-	if len(keys) != 100 {
-		t.Error("We should have counted 100 elements.")
+	m.SetMarshalFunc(func(key string, v interface{}) (interface{}, error) {
+		if _, ok := v.(chan int); ok {
+			return "chan", nil
+		}
+		return v, nil
+	})
+	j, err := json.Marshal(m)
+	if err != nil || string(j) != `{"name":"elephant","ready":"chan"}` {
+		t.Error("unexpected json", string(j), err)
 	}
-}
 
-func TestMInsert(t *testing.T) {
-	animals := map[string]interface{}{
-		"elephant": Animal{"elephant"},
-		"monkey":   Animal{"monkey"},
+	errBoom := errors.New("boom")
+	m.SetMarshalFunc(func(key string, v interface{}) (interface{}, error) { return nil, errBoom })
+	if _, err := m.MarshalJSON(); err != errBoom {
+		t.Error("MarshalJSON should return the error of the MarshalFunc, got", err)
 	}
-	m := New(64)
-	m.MSet(animals)
 
-	if m.Count() != 2 {
-		t.Error("map should contain exactly two elements.")
+	m.SetMarshalFunc(nil)
+	m.Remove("ready")
+	if j, _ := json.Marshal(m); string(j) != `{"name":"elephant"}` {
+		t.Error("values should be marshaled as is again, got", string(j))
 	}
 }
 
-func TestFnv32(t *testing.T) {
-	key := []byte("ABC")
-
-	hasher := fnv.New32()
-	hasher.Write(key)
-	if fnv32(string(key)) != hasher.Sum32() {
-		t.Errorf("Bundled fnv32 produced %d, expected result from hash/fnv32 is %d", fnv32(string(key)), hasher.Sum32())
+func TestJsonMarshalSorted(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
 	}
-}
-
-func TestXXHash(t *testing.T) {
-	key := []byte("ABC")
+	m.Set("<html> & \"quotes\"", []int{1, 2})
+	m.Set("nested", map[string]interface{}{"z": 1, "a": nil})
 
-	hasher := xxhash.New()
-	_, err := hasher.Write(key)
+	j, err := json.Marshal(m)
 	if err != nil {
-		t.Error("github.com/cespare/xxhash function went wrong")
-	} else if hasher.Sum64() != xxHash64(key) {
-		t.Errorf("Bundled xxHash64 produced %d, expected result from github.com/cespare/xxhash is %d", xxHash64(key), hasher.Sum64())
+		t.Fatal(err)
+	}
+	// encoding/json sorts map keys too.
+	expected, _ := json.Marshal(m.Items())
+	if string(j) != string(expected) {
+		t.Error("json", string(j), "differ from expected", string(expected))
 	}
-}
 
-func TestUpsert(t *testing.T) {
-	dolphin := Animal{"dolphin"}
-	whale := Animal{"whale"}
-	tiger := Animal{"tiger"}
-	lion := Animal{"lion"}
+	again, _ := json.Marshal(m)
+	if string(again) != string(j) {
+		t.Error("marshaling the same map should be deterministic.")
+	}
 
-	cb := func(exists bool, valueInMap interface{}, newValue interface{}) interface{} {
-		nv := newValue.(Animal)
-		if !exists {
-			return []Animal{nv}
-		}
-		res := valueInMap.([]Animal)
-		return append(res, nv)
+	if j, _ := json.Marshal(New(4)); string(j) != "{}" {
+		t.Error("empty map should marshal to {}, got", string(j))
+	}
+
+	m.Set("func", func() {})
+	if _, err := json.Marshal(m); err == nil {
+		t.Error("Expecting an error for values json can't encode.")
 	}
+}
 
+func TestJsonUnmarshal(t *testing.T) {
 	m := New(64)
-	m.Set("marine", []Animal{dolphin})
-	m.Upsert("marine", whale, cb)
+	m.Set("a", "kept")
+	m.Set("b", "overwritten")
+	err := json.Unmarshal([]byte(`{"b":2,"c":{"d":[1,"x"]}}`), m)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.Count() != 3 {
+		t.Error("map should contain exactly three elements.")
+	}
+
+	if v, _ := m.Get("a"); v != "kept" {
+		t.Error("existing elements should be kept.")
+	}
+
+	if v, _ := m.Get("b"); v != float64(2) {
+		t.Error("existing elements should be overwritten.")
+	}
+
+	if v, _ := m.Get("c"); v.(map[string]interface{})["d"].([]interface{})[1] != "x" {
+		t.Error("nested objects should decode like encoding/json does.")
+	}
+
+	if err := json.Unmarshal([]byte(`[1]`), m); err == nil {
+		t.Error("expecting an error for a non object.")
+	}
+}
+
+func TestJsonRoundTrip(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	j, err := json.Marshal(m)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var decoded ConcurrentHashMap
+	if err := json.Unmarshal(j, &decoded); err != nil {
+		t.Error(err)
+	}
+
+	if decoded.Shards != SHARDS_COUNT || decoded.Count() != 100 {
+		t.Error("zero map should be initialized with SHARDS_COUNT shards.")
+	}
+
+	if v, _ := decoded.Get("42"); v != "42" {
+		t.Error("item was modified.")
+	}
+}
+
+type gobAnimal struct {
+	Name string
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	gob.Register(gobAnimal{})
+
+	m := New(64)
+	m.Set("elephant", gobAnimal{"elephant"})
+	m.Set("count", 3)
+	m.Set("name", "zoo")
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ConcurrentHashMap
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Count() != 3 {
+		t.Error("Expecting 3 elements, got", decoded.Count())
+	}
+	// Unlike JSON the concrete types are kept.
+	if v, _ := decoded.Get("elephant"); v != (gobAnimal{"elephant"}) {
+		t.Error("struct value should survive the round trip, got", v)
+	}
+	if v, _ := decoded.Get("count"); v != 3 {
+		t.Error("int value should survive the round trip, got", v)
+	}
+
+	if err := decoded.GobDecode([]byte("garbage")); err == nil {
+		t.Error("Expecting an error for invalid input.")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	m := New(64)
+
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	keys := m.Keys()
+	if len(keys) != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+}
+
+func TestValues(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	values := m.Values()
+	if len(values) != 100 {
+		t.Error("Expecting 100 values, got", len(values))
+	}
+	sum := 0
+	for _, v := range values {
+		sum += v.(int)
+	}
+	if sum != 4950 {
+		t.Error("Expecting every value once, sum is", sum)
+	}
+}
+
+func TestKeysChan(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	seen := make(map[string]bool)
+	keys, stop := m.KeysChan()
+	for key := range keys {
+		seen[key] = true
+		// Shards aren't locked while keys are consumed.
+		m.Set(key, nil)
+	}
+	stop()
+	if len(seen) != 100 {
+		t.Error("Expecting 100 distinct keys, got", len(seen))
+	}
+
+	// Abandon the range right away, stop must end the producer.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		keys, stop := m.KeysChan()
+		for range keys {
+			break
+		}
+		stop()
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned KeysChan leaked goroutines.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeysWithPrefix(t *testing.T) {
+	m := New(64)
+
+	// Insert 100 elements.
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	keys := m.KeysWithPrefix("1")
+	sort.Strings(keys)
+	expected := []string{"1", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19"}
+	if len(keys) != len(expected) {
+		t.Fatal("unexpected keys", keys)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Error("unexpected key", keys[i])
+		}
+	}
+
+	if len(m.KeysWithPrefix("x")) != 0 {
+		t.Error("no key should match.")
+	}
+}
+
+func TestMInsert(t *testing.T) {
+	animals := map[string]interface{}{
+		"elephant": Animal{"elephant"},
+		"monkey":   Animal{"monkey"},
+	}
+	m := New(64)
+	m.MSet(animals)
+
+	if m.Count() != 2 {
+		t.Error("map should contain exactly two elements.")
+	}
+}
+
+func TestMSetWithPolicy(t *testing.T) {
+	data := map[string]interface{}{
+		"elephant": Animal{"elephant"},
+		"monkey":   Animal{"monkey"},
+	}
+
+	m := New(64)
+	m.Set("elephant", Animal{"old elephant"})
+	if written := m.MSetWithPolicy(data, InsertOnly); written != 1 {
+		t.Error("InsertOnly should only write the missing key, wrote", written)
+	}
+	if v, _ := m.Get("elephant"); v != (Animal{"old elephant"}) {
+		t.Error("InsertOnly overwrote an existing key.")
+	}
+
+	m = New(64)
+	m.Set("elephant", Animal{"old elephant"})
+	if written := m.MSetWithPolicy(data, UpdateOnly); written != 1 {
+		t.Error("UpdateOnly should only write the existing key, wrote", written)
+	}
+	if v, _ := m.Get("elephant"); v != (Animal{"elephant"}) || m.Has("monkey") {
+		t.Error("UpdateOnly should only update existing keys.")
+	}
+
+	m = New(64)
+	m.Set("elephant", Animal{"old elephant"})
+	if written := m.MSetWithPolicy(data, Overwrite); written != 2 {
+		t.Error("Overwrite should write every key, wrote", written)
+	}
+	if v, _ := m.Get("elephant"); v != (Animal{"elephant"}) || m.Count() != 2 {
+		t.Error("Overwrite should behave like MSet.")
+	}
+}
+
+func TestFnv32(t *testing.T) {
+	key := []byte("ABC")
+
+	hasher := fnv.New32()
+	hasher.Write(key)
+	if fnv32(string(key)) != hasher.Sum32() {
+		t.Errorf("Bundled fnv32 produced %d, expected result from hash/fnv32 is %d", fnv32(string(key)), hasher.Sum32())
+	}
+}
+
+func TestXXHash(t *testing.T) {
+	key := []byte("ABC")
+
+	hasher := xxhash.New()
+	_, err := hasher.Write(key)
+	if err != nil {
+		t.Error("github.com/cespare/xxhash function went wrong")
+	} else if hasher.Sum64() != xxHash64(key) {
+		t.Errorf("Bundled xxHash64 produced %d, expected result from github.com/cespare/xxhash is %d", xxHash64(key), hasher.Sum64())
+	}
+}
+
+func TestShardPlacementIsStable(t *testing.T) {
+	// Persisted placements rely on these, they must never change.
+	placements := map[string]int{"elephant": 6, "monkey": 18, "dog": 13, "": 5}
+	m := New(32)
+	g := NewG[int](32)
+	for key, want := range placements {
+		if got := m.ShardIndex(key); got != want {
+			t.Errorf("key %q should be in shard %d, got %d", key, want, got)
+		}
+		if g.GetShard(key) != g.HashMap[want] {
+			t.Errorf("key %q should be in shard %d of the typed map", key, want)
+		}
+	}
+
+	if got := shardOf(math.MaxUint32, 7); got != math.MaxUint32%7 {
+		t.Error("shardOf should take the modulo on 32 bits, got", got)
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		idx := m.ShardIndex(key)
+		if idx != int(fnv32(key)%64) || m.HashMap[idx] != m.GetShard(key) {
+			t.Error("ShardIndex disagrees with GetShard for", key)
+		}
+	}
+
+	m = NewWithHasher(7, XXHash32)
+	if m.ShardIndex("elephant") != int(XXHash32("elephant")%7) {
+		t.Error("ShardIndex should use the map's hasher.")
+	}
+}
+
+func TestShardByIndex(t *testing.T) {
+	m := New(8)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	total := 0
+	for i := 0; i < 8; i++ {
+		shard := m.ShardByIndex(i)
+		if shard != m.HashMap[i] {
+			t.Error("ShardByIndex returned the wrong shard", i)
+		}
+		shard.ForEach(func(key string, v interface{}) {
+			if m.ShardIndex(key) != i {
+				t.Error("element", key, "doesn't belong to shard", i)
+			}
+			total += v.(int)
+		})
+	}
+	if total != 4950 {
+		t.Error("ForEach should visit every element once, sum is", total)
+	}
+
+	if m.ShardByIndex(-1) != nil || m.ShardByIndex(8) != nil {
+		t.Error("out of range indexes should return nil.")
+	}
+}
+
+func TestSingleShard(t *testing.T) {
+	m := NewWithHasher(1, func(key string) uint32 {
+		t.Error("a single shard map shouldn't hash keys.")
+		return 0
+	})
+	for i := 0; i < 10; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	if m.Count() != 10 || m.ShardIndex("1") != 0 {
+		t.Error("every element should live in the only shard.")
+	}
+}
+
+func TestNewWithHasher(t *testing.T) {
+	m := NewWithHasher(64, XXHash32)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if m.GetShard(key) != m.HashMap[XXHash32(key)%64] {
+			t.Error("GetShard should use the given hasher.")
+		}
+		if v, _ := m.Get(key); v != (Animal{key}) {
+			t.Error("item was modified.")
+		}
+	}
+
+	if c := m.Clone(); c.GetShard("42") != c.HashMap[XXHash32("42")%64] || !c.Has("42") {
+		t.Error("Clone should keep the hasher.")
+	}
+
+	if d := NewWithHasher(64, nil); d.GetShard("42") != d.HashMap[fnv32("42")%64] {
+		t.Error("a nil hasher should default to fnv32.")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	dolphin := Animal{"dolphin"}
+	whale := Animal{"whale"}
+	tiger := Animal{"tiger"}
+	lion := Animal{"lion"}
+
+	cb := func(exists bool, valueInMap interface{}, newValue interface{}) interface{} {
+		nv := newValue.(Animal)
+		if !exists {
+			return []Animal{nv}
+		}
+		res := valueInMap.([]Animal)
+		return append(res, nv)
+	}
+
+	m := New(64)
+	m.Set("marine", []Animal{dolphin})
+	m.Upsert("marine", whale, cb)
 	m.Upsert("predator", tiger, cb)
 	m.Upsert("predator", lion, cb)
 
@@ -481,6 +2416,96 @@ func TestUpsert(t *testing.T) {
 	}
 }
 
+func TestMSetTuples(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	tuples := make([]Tuple, 0, 100)
+	for item := range m.IterBuffered() {
+		tuples = append(tuples, item)
+	}
+	tuples = append(tuples, Tuple{"42", Animal{"last"}})
+
+	restored := New(16)
+	restored.MSetTuples(tuples)
+	if restored.Count() != 100 || restored.Len() != 100 {
+		t.Error("Expecting 100 elements, got", restored.Count())
+	}
+	if v, _ := restored.Get("7"); v != (Animal{"7"}) {
+		t.Error("MSetTuples lost an element.")
+	}
+	if v, _ := restored.Get("42"); v != (Animal{"last"}) {
+		t.Error("the last tuple of a key should win, got", v)
+	}
+
+	restored.MSetTuples(nil)
+	if restored.Count() != 100 {
+		t.Error("no tuples shouldn't change the map.")
+	}
+}
+
+func TestMUpsert(t *testing.T) {
+	m := New(8)
+	m.Set("a", 1)
+	m.Set("b", 2)
+
+	sum := func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		if !exist {
+			return newValue
+		}
+		return valueInMap.(int) + newValue.(int)
+	}
+	deltas := map[string]interface{}{"a": 10, "b": 20}
+	for i := 0; i < 100; i++ {
+		deltas[strconv.Itoa(i)] = i
+	}
+	m.MUpsert(deltas, sum)
+
+	if v, _ := m.Get("a"); v != 11 {
+		t.Error("Expecting a to be 11, got", v)
+	}
+	if v, _ := m.Get("b"); v != 22 {
+		t.Error("Expecting b to be 22, got", v)
+	}
+	if v, _ := m.Get("42"); v != 42 || m.Len() != 102 {
+		t.Error("missing keys should be inserted.")
+	}
+}
+
+func TestUpsertTx(t *testing.T) {
+	m := New(64)
+	bump := func(exists bool, current interface{}) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		// Only versions below 2 pass validation.
+		if current.(int) >= 2 {
+			return nil, false
+		}
+		return current.(int) + 1, true
+	}
+
+	if v, stored := m.UpsertTx("version", bump); !stored || v != 1 {
+		t.Error("missing key should be inserted, got", v, stored)
+	}
+	if v, stored := m.UpsertTx("version", bump); !stored || v != 2 {
+		t.Error("existing key should be updated, got", v, stored)
+	}
+	if v, stored := m.UpsertTx("version", bump); stored || v != 2 {
+		t.Error("aborted upsert should return the current value, got", v, stored)
+	}
+	if v, _ := m.Get("version"); v != 2 || m.Len() != 1 {
+		t.Error("aborted upsert shouldn't change the map.")
+	}
+
+	abort := func(bool, interface{}) (interface{}, bool) { return "ignored", false }
+	if v, stored := m.UpsertTx("missing", abort); stored || v != nil || m.Has("missing") {
+		t.Error("aborted insert shouldn't add the key.")
+	}
+}
+
 func TestUpdateCb(t *testing.T) {
 	dolphin := Animal{"dolphin"}
 	whale := Animal{"whale"}
@@ -534,8 +2559,57 @@ func TestUpdateCb(t *testing.T) {
 	}
 }
 
-func TestUpdate(t *testing.T) {
-	dolphin := Animal{"dolphin"}
+func TestSetIfPresentFunc(t *testing.T) {
+	m := New(64)
+	// Slices aren't comparable, SetIfPresent would panic on them.
+	m.Set("herd", []Animal{{"elephant"}})
+
+	sameHerd := func(current interface{}) bool {
+		herd, ok := current.([]Animal)
+		return ok && len(herd) == 1 && herd[0] == Animal{"elephant"}
+	}
+
+	if !m.SetIfPresentFunc("herd", []Animal{{"elephant"}, {"calf"}}, sameHerd) {
+		t.Error("SetIfPresentFunc should replace a matching value.")
+	}
+	if m.SetIfPresentFunc("herd", []Animal{}, sameHerd) {
+		t.Error("SetIfPresentFunc shouldn't replace a value eq rejects.")
+	}
+	if v, _ := m.Get("herd"); len(v.([]Animal)) != 2 {
+		t.Error("herd should hold the calf.")
+	}
+
+	if m.SetIfPresentFunc("missing", 1, func(interface{}) bool { return true }) || m.Has("missing") {
+		t.Error("SetIfPresentFunc shouldn't insert missing keys.")
+	}
+}
+
+func TestAppendValues(t *testing.T) {
+	m := New(64)
+
+	if err := m.AppendValues("animals", Animal{"elephant"}); err != nil {
+		t.Error(err)
+	}
+	if err := m.AppendValues("animals", Animal{"monkey"}, Animal{"dog"}); err != nil {
+		t.Error(err)
+	}
+	v, _ := m.Get("animals")
+	expected := []interface{}{Animal{"elephant"}, Animal{"monkey"}, Animal{"dog"}}
+	if !reflect.DeepEqual(v, expected) {
+		t.Error("Expecting", expected, "got", v)
+	}
+
+	m.Set("name", "elephant")
+	if err := m.AppendValues("name", "monkey"); !errors.Is(err, ErrNotSlice) {
+		t.Error("expecting ErrNotSlice, got", err)
+	}
+	if v, _ := m.Get("name"); v != "elephant" {
+		t.Error("a failed AppendValues shouldn't change the value, got", v)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dolphin := Animal{"dolphin"}
 	whale := Animal{"whale"}
 	tiger := Animal{"tiger"}
 	lion := Animal{"lion"}
@@ -706,3 +2780,861 @@ func TestUnDrainedIterBuffered(t *testing.T) {
 		t.Error("We should have counted 200 elements.")
 	}
 }
+
+func TestGetOrSet(t *testing.T) {
+	m := New(64)
+	elephant := Animal{"elephant"}
+	monkey := Animal{"monkey"}
+
+	actual, loaded := m.GetOrSet("animal", elephant)
+	if loaded || actual != elephant {
+		t.Error("GetOrSet should have stored the given value.")
+	}
+
+	actual, loaded = m.GetOrSet("animal", monkey)
+	if !loaded || actual != elephant {
+		t.Error("GetOrSet should have returned the existing value.")
+	}
+
+	if v, _ := m.Get("animal"); v != elephant {
+		t.Error("GetOrSet overwrote an existing value.")
+	}
+}
+
+func TestGetOrCompute(t *testing.T) {
+	m := New(64)
+	calls := 0
+	fn := func() interface{} {
+		calls++
+		return Animal{"elephant"}
+	}
+
+	v, computed := m.GetOrCompute("animal", fn)
+	if !computed || v != (Animal{"elephant"}) {
+		t.Error("GetOrCompute should have stored the computed value.")
+	}
+
+	v, computed = m.GetOrCompute("animal", fn)
+	if computed || v != (Animal{"elephant"}) {
+		t.Error("GetOrCompute should have returned the existing value.")
+	}
+
+	if calls != 1 {
+		t.Error("fn should only be called for a missing key.")
+	}
+}
+
+func TestGetAndSet(t *testing.T) {
+	m := New(64)
+
+	previous, existed := m.GetAndSet("elephant", Animal{"elephant"})
+	if existed || previous != nil {
+		t.Error("Expecting no previous value for a new key.")
+	}
+
+	previous, existed = m.GetAndSet("elephant", Animal{"big elephant"})
+	if !existed || previous != (Animal{"elephant"}) {
+		t.Error("GetAndSet should return the replaced value.")
+	}
+
+	if v, _ := m.Get("elephant"); v != (Animal{"big elephant"}) || m.Len() != 1 {
+		t.Error("GetAndSet should store the new value.")
+	}
+}
+
+func TestWithShardLock(t *testing.T) {
+	m := New(1)
+	m.Set("checking", 100)
+	m.Set("savings", 0)
+
+	m.WithShardLock("checking", func(items map[string]interface{}) {
+		// With a single shard every key is co-located.
+		items["checking"] = items["checking"].(int) - 30
+		items["savings"] = items["savings"].(int) + 30
+		items["audit"] = "moved 30"
+		delete(items, "missing")
+	})
+
+	if v, _ := m.Get("checking"); v != 70 {
+		t.Error("Expecting checking to be 70, got", v)
+	}
+	if v, _ := m.Get("savings"); v != 30 {
+		t.Error("Expecting savings to be 30, got", v)
+	}
+	if m.Len() != 3 || m.Count() != 3 {
+		t.Error("Len should account for keys added by fn.")
+	}
+
+	m.WithShardLock("audit", func(items map[string]interface{}) {
+		delete(items, "audit")
+	})
+	if m.Has("audit") || m.Len() != 2 {
+		t.Error("Len should account for keys removed by fn.")
+	}
+}
+
+func TestWithReadWriteLock(t *testing.T) {
+	m := New(1)
+	m.Set("checking", 100)
+	m.Set("savings", 0)
+
+	m.WithWriteLock("checking", func(items map[string]interface{}) {
+		items["checking"] = items["checking"].(int) - 30
+		items["savings"] = items["savings"].(int) + 30
+	})
+
+	total := 0
+	m.WithReadLock("savings", func(items map[string]interface{}) {
+		total = items["checking"].(int) + items["savings"].(int)
+	})
+	if total != 100 {
+		t.Error("Expecting a total of 100, got", total)
+	}
+	if v, _ := m.Get("savings"); v != 30 || m.Len() != 2 {
+		t.Error("Expecting savings to be 30, got", v)
+	}
+}
+
+func TestRemoveIf(t *testing.T) {
+	m := New(64)
+	m.Set("fresh", Animal{"fresh"})
+	m.Set("stale", Animal{"stale"})
+
+	isStale := func(v interface{}, exists bool) bool {
+		return exists && v.(Animal).name == "stale"
+	}
+
+	if m.RemoveIf("fresh", isStale) {
+		t.Error("RemoveIf removed an element cb rejected.")
+	}
+
+	if !m.RemoveIf("stale", isStale) {
+		t.Error("RemoveIf didn't remove an element cb accepted.")
+	}
+
+	if m.RemoveIf("missing", func(v interface{}, exists bool) bool { return true }) {
+		t.Error("RemoveIf can't remove a missing element.")
+	}
+
+	if m.Count() != 1 || !m.Has("fresh") {
+		t.Error("map should only contain the fresh element.")
+	}
+}
+
+func TestPopIf(t *testing.T) {
+	m := New(64)
+	m.Set("ready", Animal{"ready"})
+	m.Set("pending", Animal{"pending"})
+
+	isReady := func(v interface{}) bool {
+		return v.(Animal).name == "ready"
+	}
+
+	if v, ok := m.PopIf("pending", isReady); ok || v != nil {
+		t.Error("PopIf claimed an element cb rejected.")
+	}
+
+	if v, ok := m.PopIf("ready", isReady); !ok || v != (Animal{"ready"}) {
+		t.Error("PopIf didn't claim an element cb accepted.")
+	}
+
+	if _, ok := m.PopIf("ready", isReady); ok {
+		t.Error("PopIf keeps finding the claimed element.")
+	}
+
+	if m.Count() != 1 || !m.Has("pending") {
+		t.Error("map should only contain the pending element.")
+	}
+}
+
+func TestCompareAndRemove(t *testing.T) {
+	m := New(64)
+	m.Set("elephant", Animal{"elephant"})
+
+	if m.CompareAndRemove("elephant", Animal{"monkey"}) {
+		t.Error("CompareAndRemove shouldn't remove a different value.")
+	}
+	if m.CompareAndRemove("monkey", nil) {
+		t.Error("CompareAndRemove shouldn't report missing keys as removed.")
+	}
+	if !m.CompareAndRemove("elephant", Animal{"elephant"}) {
+		t.Error("CompareAndRemove should remove a matching value.")
+	}
+	if m.Has("elephant") || m.Len() != 0 {
+		t.Error("elephant should have been removed.")
+	}
+}
+
+func TestMGet(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	items := m.MGet([]string{"1", "42", "99", "missing", "42"})
+
+	if len(items) != 3 {
+		t.Error("MGet should only return the present keys.")
+	}
+
+	if items["42"] != (Animal{"42"}) {
+		t.Error("item was modified.")
+	}
+
+	if _, ok := items["missing"]; ok {
+		t.Error("missing keys should be absent from the result.")
+	}
+}
+
+func TestGetOrdered(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	keys := []string{"42", "missing", "7", "42", "99"}
+	values, found := m.GetOrdered(keys)
+	expected := []interface{}{42, nil, 7, 42, 99}
+	for i := range keys {
+		if values[i] != expected[i] || found[i] != (expected[i] != nil) {
+			t.Error("unexpected result for", keys[i], values[i], found[i])
+		}
+	}
+
+	if values, found := m.GetOrdered(nil); len(values) != 0 || len(found) != 0 {
+		t.Error("no keys should give empty results.")
+	}
+}
+
+func TestMRemove(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	removed := m.MRemove([]string{"1", "42", "99", "missing", "42"})
+
+	if removed != 3 {
+		t.Error("MRemove should report the three removed elements, got", removed)
+	}
+
+	if m.Count() != 97 || m.Has("42") {
+		t.Error("Expecting 97 element within map.")
+	}
+}
+
+func TestMPop(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	popped := m.MPop([]string{"1", "42", "99", "missing", "42"})
+
+	if len(popped) != 3 || popped["42"] != (Animal{"42"}) {
+		t.Error("MPop should return the three popped elements, got", popped)
+	}
+	if _, ok := popped["missing"]; ok {
+		t.Error("missing keys should be absent from the result.")
+	}
+	if m.Count() != 97 || m.Len() != 97 || m.Has("42") {
+		t.Error("Expecting 97 element within map.")
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	removed := m.RemoveAll(func(key string, v interface{}) bool {
+		return v.(int)%2 == 0
+	})
+
+	if removed != 50 {
+		t.Error("RemoveAll should report the 50 removed elements, got", removed)
+	}
+	if m.Count() != 50 || m.Len() != 50 || m.Has("42") || !m.Has("43") {
+		t.Error("Expecting only the odd elements within map.")
+	}
+
+	if removed := m.RemoveAll(func(key string, v interface{}) bool { return false }); removed != 0 {
+		t.Error("RemoveAll shouldn't remove anything, got", removed)
+	}
+}
+
+func TestClone(t *testing.T) {
+	m := New(64)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	clone := m.Clone()
+
+	if clone.Shards != m.Shards || clone.Count() != 100 {
+		t.Error("clone should have the same shards and elements.")
+	}
+
+	m.Set("elephant", Animal{"elephant"})
+	m.Remove("42")
+	clone.Set("monkey", Animal{"monkey"})
+
+	if clone.Has("elephant") || !clone.Has("42") {
+		t.Error("clone shouldn't observe changes to the original map.")
+	}
+
+	if m.Has("monkey") {
+		t.Error("original map shouldn't observe changes to the clone.")
+	}
+
+	if v, _ := clone.Get("7"); v != (Animal{"7"}) {
+		t.Error("item was modified.")
+	}
+}
+
+func TestCloneWith(t *testing.T) {
+	m := New(64)
+	m.Set("elephant", &Animal{"elephant"})
+
+	c := m.CloneWith(func(v interface{}) interface{} {
+		animal := *v.(*Animal)
+		return &animal
+	})
+	v, _ := c.Get("elephant")
+	v.(*Animal).name = "mammoth"
+
+	if orig, _ := m.Get("elephant"); orig.(*Animal).name != "elephant" {
+		t.Error("changing a deep cloned value shouldn't affect the original.")
+	}
+	if c.Len() != 1 || c.Shards != m.Shards {
+		t.Error("clone should have the same layout and elements.")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	m := New(64)
+	other := New(7)
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+		other.Set(strconv.Itoa(i+50), i+50)
+	}
+
+	m.Merge(other, func(existing, incoming interface{}) interface{} {
+		return existing.(int) + incoming.(int)
+	})
+
+	if m.Count() != 150 {
+		t.Error("Expecting 150 element within map, got", m.Count())
+	}
+
+	if v, _ := m.Get("10"); v != 10 {
+		t.Error("elements only in m shouldn't change.")
+	}
+
+	if v, _ := m.Get("60"); v != 120 {
+		t.Error("onConflict should decide conflicting values.")
+	}
+
+	if v, _ := m.Get("140"); v != 140 {
+		t.Error("elements only in other should be inserted.")
+	}
+
+	for i := 0; i < 150; i++ {
+		key := strconv.Itoa(i)
+		if _, ok := m.GetShard(key).items[key]; !ok {
+			t.Error("element stored in the wrong shard", key)
+		}
+	}
+
+	m.Merge(other, nil)
+	if v, _ := m.Get("60"); v != 60 {
+		t.Error("incoming value should win without onConflict.")
+	}
+}
+
+func TestIncrementInt(t *testing.T) {
+	m := New(64)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			m.IncrementInt("counter", 2)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := m.Get("counter"); v != int64(200) {
+		t.Error("Expecting counter to be 200, got", v)
+	}
+
+	m.Set("int", 5)
+	if total := m.IncrementInt("int", -1); total != 4 {
+		t.Error("int values should be incremented, got", total)
+	}
+
+	m.Set("animal", Animal{"elephant"})
+	if total := m.IncrementInt("animal", 3); total != 3 {
+		t.Error("non integer values should count as 0, got", total)
+	}
+}
+
+func TestIncrementFloat(t *testing.T) {
+	m := New(64)
+
+	m.IncrementFloat("ratio", 0.5)
+	if total := m.IncrementFloat("ratio", 0.25); total != 0.75 {
+		t.Error("Expecting ratio to be 0.75, got", total)
+	}
+
+	m.Set("int", 5)
+	if total := m.IncrementFloat("int", 1.5); total != 1.5 {
+		t.Error("non float values should count as 0, got", total)
+	}
+}
+
+func TestCompute(t *testing.T) {
+	m := New(64)
+	inc := func(old interface{}, loaded bool) (interface{}, bool) {
+		if !loaded {
+			return 1, false
+		}
+		return old.(int) + 1, false
+	}
+
+	m.Compute("counter", inc)
+	if v, ok := m.Compute("counter", inc); !ok || v != 2 {
+		t.Error("Compute should have stored 2, got", v)
+	}
+
+	v, ok := m.Compute("counter", func(old interface{}, loaded bool) (interface{}, bool) {
+		return nil, old.(int) == 2
+	})
+	if ok || v != nil || m.Has("counter") {
+		t.Error("Compute should have deleted the key.")
+	}
+
+	if _, ok := m.Compute("missing", func(old interface{}, loaded bool) (interface{}, bool) {
+		return nil, true
+	}); ok || m.Count() != 0 {
+		t.Error("deleting a missing key should leave the map empty.")
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	m := New(64)
+
+	v1 := m.SetVersioned("doc", []string{"draft"})
+	if v1 == 0 {
+		t.Error("SetVersioned should return a non zero version.")
+	}
+	value, version, ok := m.GetVersioned("doc")
+	if !ok || version != v1 || value.([]string)[0] != "draft" {
+		t.Error("GetVersioned should return the value and its version.")
+	}
+
+	if !m.CompareVersionAndSet("doc", []string{"review"}, v1) {
+		t.Error("CompareVersionAndSet should succeed with the current version.")
+	}
+	if m.CompareVersionAndSet("doc", []string{"stale"}, v1) {
+		t.Error("CompareVersionAndSet should fail with a stale version.")
+	}
+	_, v2, _ := m.GetVersioned("doc")
+
+	// Writes by other methods bump the version too.
+	m.Set("doc", []string{"final"})
+	_, v3, _ := m.GetVersioned("doc")
+	if v2 <= v1 || v3 <= v2 {
+		t.Error("Expecting growing versions, got", v1, v2, v3)
+	}
+
+	m.Remove("doc")
+	if m.CompareVersionAndSet("doc", nil, v3) || m.Has("doc") {
+		t.Error("CompareVersionAndSet shouldn't insert removed keys.")
+	}
+	v4 := m.SetVersioned("doc", nil)
+	if v4 <= v3 {
+		t.Error("versions should keep growing once a key was removed, got", v4)
+	}
+	if m.CompareVersionAndSet("doc", "stale", v1) {
+		t.Error("a version taken before the removal shouldn't match.")
+	}
+
+	m.Clear()
+	if v := m.SetVersioned("doc", nil); v <= v4 {
+		t.Error("versions should keep growing once the map was cleared, got", v)
+	}
+	v5 := m.SetVersioned("doc", nil)
+
+	m.Resize(7)
+	if _, version, _ := m.GetVersioned("doc"); version != v5 {
+		t.Error("Resize should keep versions.")
+	}
+
+	m.Set("plain", 1)
+	if _, version, ok := m.GetVersioned("plain"); !ok || version <= v5 {
+		t.Error("writes of a versioned map should record versions in every shard, got", version)
+	}
+}
+
+func TestVersionedUntracked(t *testing.T) {
+	m := New(1)
+	m.Set("a", 1)
+	_, version, _ := m.GetVersioned("a")
+	if version != 0 {
+		t.Error("elements written before SetVersioned shouldn't have a version, got", version)
+	}
+	// Another goroutine writes meanwhile.
+	m.Set("a", 2)
+	if m.CompareVersionAndSet("a", 3, version) {
+		t.Error("CompareVersionAndSet shouldn't match elements without a version.")
+	}
+	if v, _ := m.Get("a"); v != 2 {
+		t.Error("the concurrent write was lost, got", v)
+	}
+
+	m.SetVersioned("b", 1)
+	clone := m.Clone()
+	_, version, _ = clone.GetVersioned("b")
+	clone.Set("b", 2)
+	if clone.CompareVersionAndSet("b", 3, version) {
+		t.Error("writes to a clone should bump versions.")
+	}
+}
+
+func TestVersionedConcurrent(t *testing.T) {
+	m := New(8)
+	initial := m.SetVersioned("counter", 0)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				// Optimistic retry loop.
+				for {
+					v, version, _ := m.GetVersioned("counter")
+					if m.CompareVersionAndSet("counter", v.(int)+1, version) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, version, _ := m.GetVersioned("counter"); v != 800 || version != initial+800 {
+		t.Error("updates were lost", v, version)
+	}
+}
+
+func TestSetWithSize(t *testing.T) {
+	m := New(8)
+	m.SetWithSize("a", "aaaa", 4)
+	m.SetWithSize("b", "bb", 2)
+	m.Set("c", "not accounted")
+	if m.TotalSize() != 6 {
+		t.Error("Expecting a total size of 6, got", m.TotalSize())
+	}
+
+	m.SetWithSize("a", "aaaaaaaa", 8)
+	if m.TotalSize() != 10 {
+		t.Error("overwriting should replace the size, got", m.TotalSize())
+	}
+	m.Set("b", "unknown")
+	if m.TotalSize() != 8 {
+		t.Error("overwriting without a size should drop it, got", m.TotalSize())
+	}
+	m.SetWithSize("b", "bb", 2)
+	m.Remove("a")
+	if m.TotalSize() != 2 {
+		t.Error("removing should subtract the size, got", m.TotalSize())
+	}
+
+	m.Resize(32)
+	if m.TotalSize() != 2 {
+		t.Error("Resize shouldn't change the total size, got", m.TotalSize())
+	}
+	m.Remove("b")
+	if m.TotalSize() != 0 {
+		t.Error("sizes should follow their keys across Resize, got", m.TotalSize())
+	}
+
+	for i := 0; i < 10; i++ {
+		m.SetWithSize(strconv.Itoa(i), i, 10)
+	}
+	m.WithShardLock("0", func(items map[string]interface{}) {
+		delete(items, "0")
+	})
+	if m.TotalSize() != 90 {
+		t.Error("WithShardLock removals should subtract the size, got", m.TotalSize())
+	}
+
+	clone := m.Clone()
+	if clone.TotalSize() != 90 {
+		t.Error("Clone should copy the sizes, got", clone.TotalSize())
+	}
+	clone.Remove("1")
+	if clone.TotalSize() != 80 || m.TotalSize() != 90 {
+		t.Error("sizes of a clone should be independent, got", clone.TotalSize(), m.TotalSize())
+	}
+	clone.RestoreShards(clone.ExportShards())
+	if clone.TotalSize() != 0 {
+		t.Error("RestoreShards should reset the total size, got", clone.TotalSize())
+	}
+	m.Clear()
+	if m.TotalSize() != 0 {
+		t.Error("Clear should reset the total size, got", m.TotalSize())
+	}
+}
+
+func TestShardsCompatible(t *testing.T) {
+	m := New(16)
+	if !m.ShardsCompatible(New(16)) || !m.ShardsCompatible(m) {
+		t.Error("maps with the same geometry should be compatible.")
+	}
+	if m.ShardsCompatible(New(8)) {
+		t.Error("maps with different shard counts aren't compatible.")
+	}
+	if m.ShardsCompatible(NewWithHasher(16, XXHash32)) {
+		t.Error("compatibility should depend on the hasher.")
+	}
+	custom := NewWithHasher(4, XXHash32)
+	if !custom.ShardsCompatible(NewWithHasher(4, XXHash32)) || !custom.ShardsCompatible(custom.Clone()) {
+		t.Error("maps using the same hasher should be compatible.")
+	}
+	resized := NewWithHasher(8, XXHash32)
+	resized.Resize(4)
+	if !custom.ShardsCompatible(resized) {
+		t.Error("Resize should keep the hasher.")
+	}
+	seeded := func(seed uint32) func(key string) uint32 {
+		return func(key string) uint32 { return fnv32(key) ^ seed }
+	}
+	withSeed := NewWithHasher(4, seeded(1))
+	if withSeed.ShardsCompatible(NewWithHasher(4, seeded(2))) || !withSeed.ShardsCompatible(withSeed.Clone()) {
+		t.Error("closures should only be compatible with themselves.")
+	}
+
+	err := m.checkCompatible(New(8))
+	if !errors.Is(err, ErrShardsMismatch) || err.Error() != "cmap: maps have a different number of shards: 16 and 8" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestSwapContents(t *testing.T) {
+	live := New(16)
+	live.Set("old", 1)
+	next := New(16)
+	next.Set("new", 2)
+	next.Set("newer", 3)
+
+	if err := live.SwapContents(next); err != nil {
+		t.Fatal(err)
+	}
+	if live.Has("old") || !live.Has("new") || !live.Has("newer") || live.Len() != 2 {
+		t.Error("live should hold the new elements.")
+	}
+	if !next.Has("old") || next.Has("new") || next.Len() != 1 {
+		t.Error("next should hold the old elements.")
+	}
+
+	if err := live.SwapContents(New(8)); !errors.Is(err, ErrShardsMismatch) {
+		t.Error("Expecting ErrShardsMismatch, got", err)
+	}
+	if err := live.SwapContents(NewWithHasher(16, XXHash32)); err != ErrHasherMismatch {
+		t.Error("Expecting ErrHasherMismatch, got", err)
+	}
+	if !live.Has("new") {
+		t.Error("failed swaps shouldn't change the map.")
+	}
+	if live.SwapContents(live) != nil || live.Len() != 2 {
+		t.Error("swapping a map with itself should be a no-op.")
+	}
+
+	a, b := NewWithHasher(16, XXHash32), NewWithHasher(16, XXHash32)
+	for i := 0; i < 100; i++ {
+		b.Set(strconv.Itoa(i), i)
+	}
+	if err := a.SwapContents(b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := a.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Fatal("elements of maps sharing a hasher should be found after a swap", i)
+		}
+	}
+	if b.Len() != 0 {
+		t.Error("Expecting an empty map, got", b.Len())
+	}
+}
+
+func TestExportRestoreShards(t *testing.T) {
+	m := New(16)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	exported := m.ExportShards()
+	if len(exported) != 16 {
+		t.Fatal("Expecting one map per shard, got", len(exported))
+	}
+	// Exported maps are copies.
+	m.Set("new", true)
+	m.Remove("42")
+	if _, ok := exported[m.ShardIndex("new")]["new"]; ok {
+		t.Error("ExportShards shouldn't return live maps.")
+	}
+
+	restored := New(16)
+	restored.Set("stale", true)
+	if err := restored.RestoreShards(exported); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Count() != 1000 || restored.Len() != 1000 || restored.Has("stale") {
+		t.Error("RestoreShards should replace every element, got", restored.Count())
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := restored.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Error("element missing after RestoreShards", i)
+		}
+	}
+
+	err := New(8).RestoreShards(m.ExportShards())
+	if !errors.Is(err, ErrShardsMismatch) {
+		t.Error("expecting ErrShardsMismatch, got", err)
+	}
+}
+
+func TestSwapContentsConcurrent(t *testing.T) {
+	a, b := New(8), New(8)
+	for i := 0; i < 100; i++ {
+		a.Set(strconv.Itoa(i), "a")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				a.SwapContents(b)
+				b.SwapContents(a)
+				if n := len(a.SnapshotConsistent()); n != 0 && n != 100 {
+					t.Error("observed a partially swapped map", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if a.Count()+b.Count() != 100 || a.Len()+b.Len() != 100 {
+		t.Error("elements were lost while swapping.")
+	}
+}
+
+func TestResize(t *testing.T) {
+	m := NewWithHasher(4, XXHash32)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	old := m.HashMap
+
+	m.Resize(64)
+
+	if m.Shards != 64 || len(m.HashMap) != 64 || len(m.ShardCounts()) != 64 {
+		t.Error("map should have 64 shards after Resize.")
+	}
+
+	if m.Count() != 1000 {
+		t.Error("Resize lost elements, got", m.Count())
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if m.GetShard(key) != m.HashMap[XXHash32(key)%64] {
+			t.Error("Resize should keep the hasher.")
+		}
+		if _, ok := m.GetShard(key).items[key]; !ok {
+			t.Error("element stored in the wrong shard", key)
+		}
+	}
+
+	m.Set("new", true)
+	for _, shard := range old {
+		if _, ok := shard.items["new"]; ok {
+			t.Error("writes shouldn't land in retired shards.")
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	m := New(4)
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	if err := m.Reset(0, XXHash32); !errors.Is(err, ErrInvalidShards) {
+		t.Error("expecting ErrInvalidShards, got", err)
+	}
+	if m.Shards != 4 || m.Count() != 1000 {
+		t.Error("a failed Reset shouldn't change the map.")
+	}
+
+	if err := m.Reset(64, XXHash32); err != nil {
+		t.Error(err)
+	}
+	if m.Shards != 64 || m.Count() != 1000 || m.Len() != 1000 {
+		t.Error("Reset lost elements, got", m.Count())
+	}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if m.ShardIndex(key) != int(XXHash32(key)%64) {
+			t.Error("Reset should switch to the new hasher.")
+		}
+		if v, ok := m.Get(key); !ok || v != i {
+			t.Error("element missing after Reset", key)
+		}
+	}
+
+	// A nil hasher goes back to fnv32.
+	if err := m.Reset(8, nil); err != nil || m.ShardIndex("42") != int(fnv32("42")%8) || !m.Has("42") {
+		t.Error("Reset should rehash with fnv32.")
+	}
+}
+
+func TestResizeConcurrent(t *testing.T) {
+	m := New(2)
+	const writers, iterations = 4, 500
+
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				key := strconv.Itoa(w*iterations + i)
+				m.Set(key, i)
+				m.IncrementInt("counter", 1)
+				if _, ok := m.Get(key); !ok {
+					t.Error("element lost while resizing", key)
+				}
+			}
+		}(w)
+	}
+	for _, shards := range []int{8, 3, 32, 1, 16} {
+		m.Resize(shards)
+	}
+	wg.Wait()
+
+	if m.Count() != writers*iterations+1 {
+		t.Error("Expecting", writers*iterations+1, "elements, got", m.Count())
+	}
+
+	if v, _ := m.Get("counter"); v != int64(writers*iterations) {
+		t.Error("increments were lost while resizing, got", v)
+	}
+}
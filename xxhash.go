@@ -6,6 +6,12 @@ import (
 	"math/bits"
 )
 
+// Sharding hasher based on xxHash64, see NewWithHasher.
+func XXHash32(key string) uint32 {
+	h := xxHash64([]byte(key))
+	return uint32(h ^ h>>32)
+}
+
 func xxHash64(b []byte) uint64 {
 
 	n := len(b)